@@ -20,13 +20,17 @@ func main() {
 	}
 
 	deleteChan := make(chan repository.DeleteRequest, 100)
+	clickChan := make(chan repository.Click, config.ClickBuffer)
+	enrichChan := make(chan repository.EnrichRequest, 100)
 	var wg sync.WaitGroup
 
-	if err := app.Run(config, storage, deleteChan, &wg); err != nil {
+	if err := app.Run(config, storage, deleteChan, clickChan, enrichChan, &wg); err != nil {
 		log.Fatal("Ошибка старта сервера", err)
 	}
 
+	// Канал переходов закрывает Run, дописав последнюю пачку
 	wg.Wait()
 	close(deleteChan)
+	close(enrichChan)
 
 }
@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	MinAliasLength = 3
+	MaxAliasLength = 32
+)
+
+const aliasCharset = Base62Alphabet + "-_"
+
+var ErrInvalidAlias = errors.New("некорректный алиас")
+
+// ValidateAlias проверяет алиас, выбранный пользователем вместо случайного
+// идентификатора. Запрещённые слова в алиасе ищутся только целыми словами.
+func ValidateAlias(alias string, filter *SlugFilter) error {
+	if len(alias) < MinAliasLength || len(alias) > MaxAliasLength {
+		return fmt.Errorf("%w: длина должна быть от %d до %d символов", ErrInvalidAlias, MinAliasLength, MaxAliasLength)
+	}
+
+	for _, c := range alias {
+		if !strings.ContainsRune(aliasCharset, c) {
+			return fmt.Errorf("%w: недопустимый символ %q", ErrInvalidAlias, c)
+		}
+	}
+
+	if filter != nil {
+		if err := filter.CheckAlias(alias); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidAlias, err)
+		}
+	}
+
+	return nil
+}
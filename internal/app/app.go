@@ -1,12 +1,19 @@
 package app
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
+	"shortener/internal"
 	"shortener/internal/app/handlers"
 	"shortener/internal/app/handlers/service/repository"
 	"shortener/internal/app/middleware"
@@ -16,25 +23,57 @@ import (
 	_ "github.com/lib/pq"
 )
 
-func Run(config *config.Config, storage repository.Storage, deleteChan chan repository.DeleteRequest, wg *sync.WaitGroup) error {
+func Run(config *config.Config, storage repository.Storage, deleteChan chan repository.DeleteRequest, clickChan chan repository.Click, enrichChan chan repository.EnrichRequest, wg *sync.WaitGroup) error {
+	// Генератор собирается один раз, когда уже известны пути сервиса для его фильтра
+	var generator internal.IDGenerator
+
 	r := chi.NewRouter()
 	r.Use(middleware.GZipMiddleware)
 	r.Use(middleware.SetUserIDCookie)
 
 	r.Post("/", func(w http.ResponseWriter, r *http.Request) {
-		handlers.PostAddURL(w, r, config, storage)
+		handlers.PostAddURL(w, r, config, storage, generator, enrichChan)
 	})
 
 	r.Get("/{id}", func(w http.ResponseWriter, r *http.Request) {
-		handlers.GetByID(w, r, config, storage)
+		handlers.GetByID(w, r, config, storage, clickChan)
+	})
+
+	r.Post("/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handlers.PostPassword(w, r, config, storage, clickChan)
+	})
+
+	// Точный путь /{id}/qr важнее /{id}/*: ссылкам с forward_path он не передаётся
+	r.Get("/{id}/qr", func(w http.ResponseWriter, r *http.Request) {
+		handlers.GetQR(w, r, config, storage)
+	})
+
+	r.Get("/{id}/*", func(w http.ResponseWriter, r *http.Request) {
+		handlers.GetByID(w, r, config, storage, clickChan)
+	})
+
+	r.Post("/{id}/*", func(w http.ResponseWriter, r *http.Request) {
+		handlers.PostPassword(w, r, config, storage, clickChan)
+	})
+
+	r.Get("/preview/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handlers.GetPreview(w, r, config, storage)
+	})
+
+	r.Get("/api/preview/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handlers.GetAPIPreview(w, r, config, storage)
 	})
 
 	r.Post("/api/shorten", func(w http.ResponseWriter, r *http.Request) {
-		handlers.PostAPIShorten(w, r, config, storage)
+		handlers.PostAPIShorten(w, r, config, storage, generator, enrichChan)
 	})
 
 	r.Get("/api/user/urls", func(w http.ResponseWriter, r *http.Request) {
-		handlers.GetUrlsHandler(w, r)
+		handlers.GetUrlsHandler(w, r, storage)
+	})
+
+	r.Get("/api/internal/stats", func(w http.ResponseWriter, r *http.Request) {
+		handlers.GetInternalStats(w, r, config, storage)
 	})
 
 	r.Get("/ping", func(w http.ResponseWriter, r *http.Request) {
@@ -42,22 +81,188 @@ func Run(config *config.Config, storage repository.Storage, deleteChan chan repo
 	})
 
 	r.Post("/api/shorten/batch", func(w http.ResponseWriter, r *http.Request) {
-		handlers.PostBatch(w, r, config, storage)
+		handlers.PostBatch(w, r, config, storage, generator, enrichChan)
+	})
+
+	r.Get("/api/user/urls/broken", func(w http.ResponseWriter, r *http.Request) {
+		handlers.GetBrokenURLs(w, r, storage)
+	})
+
+	r.Get("/api/user/urls/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handlers.GetUserURL(w, r, storage)
+	})
+
+	r.Patch("/api/user/urls/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handlers.PatchURL(w, r, storage, enrichChan)
+	})
+
+	r.Put("/api/user/urls/{id}/rules", func(w http.ResponseWriter, r *http.Request) {
+		handlers.PutURLRules(w, r, storage)
+	})
+
+	r.Put("/api/user/urls/{id}/destinations", func(w http.ResponseWriter, r *http.Request) {
+		handlers.PutURLDestinations(w, r, storage)
+	})
+
+	r.Put("/api/user/urls/{id}/fallbacks", func(w http.ResponseWriter, r *http.Request) {
+		handlers.PutURLFallbacks(w, r, storage)
+	})
+
+	r.Get("/api/user/urls/{id}/stats", func(w http.ResponseWriter, r *http.Request) {
+		handlers.GetURLStats(w, r, storage)
+	})
+
+	r.Get("/api/user/urls/{id}/history", func(w http.ResponseWriter, r *http.Request) {
+		handlers.GetURLHistory(w, r, storage)
+	})
+
+	r.Post("/api/user/urls/{id}/rollback", func(w http.ResponseWriter, r *http.Request) {
+		handlers.RollbackURL(w, r, storage, enrichChan)
 	})
 
 	r.Delete("/api/user/urls", func(w http.ResponseWriter, r *http.Request) {
 		handlers.Delete(w, r, storage, deleteChan, wg)
 	})
 
+	r.Delete("/api/user/urls/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handlers.DeleteByID(w, r, storage)
+	})
+
+	// Идентификаторы не должны совпадать с путями сервиса
+	config.ReservedPaths = routePrefixes(r)
+
+	var err error
+	if generator, err = handlers.NewIDGenerator(config, storage); err != nil {
+		return err
+	}
+
 	log.Printf("Сервер запущен на %s", config.ServerAddr)
 	log.Printf("Base URL  %s", config.BaseURL)
 	log.Printf("Файл для сохранения данных расположен %s", config.StoragePath)
 	log.Printf("База данных  %s", config.DataBaseDSN)
 	log.Printf("Хранение данных реализовано через  %s", config.TypeStorage)
+	log.Printf("Генератор идентификаторов %s, длина %d", config.IDGenerator, config.IDLength)
 
 	go repository.DeleteHandler(storage, deleteChan, wg)
 
-	return http.ListenAndServe(config.ServerAddr, r)
+	expireInterval := config.ExpireInterval
+	if expireInterval <= 0 {
+		expireInterval = time.Minute
+	}
+	go repository.ExpireHandler(storage, expireInterval)
+
+	clickFlush := config.ClickFlushInterval
+	if clickFlush <= 0 {
+		clickFlush = 5 * time.Second
+	}
+	clicksDone := make(chan struct{})
+	go func() {
+		repository.ClickHandler(storage, clickChan, clickFlush)
+		close(clicksDone)
+	}()
+
+	enrichTimeout := config.EnrichTimeout
+	if enrichTimeout <= 0 {
+		enrichTimeout = 5 * time.Second
+	}
+	enrichWorkers := config.EnrichWorkers
+	if enrichWorkers <= 0 {
+		enrichWorkers = 1
+	}
+	enrichMaxBytes := config.EnrichMaxBytes
+	if enrichMaxBytes <= 0 {
+		enrichMaxBytes = 256 << 10
+	}
+	fetcher := internal.NewHTTPMetadataFetcher(enrichTimeout, enrichMaxBytes)
+	go repository.EnrichHandler(storage, enrichChan, fetcher, enrichWorkers, enrichTimeout)
+
+	healthOptions := repository.HealthOptions{
+		Workers:   config.HealthWorkers,
+		HostDelay: config.HealthHostDelay,
+		Timeout:   config.HealthTimeout,
+	}
+	if healthOptions.Timeout <= 0 {
+		healthOptions.Timeout = 10 * time.Second
+	}
+	checker := internal.NewHTTPLinkChecker(healthOptions.Timeout)
+	if config.HealthInterval > 0 || config.FallbackProbeInterval > 0 {
+		go repository.HealthHandler(storage, checker, config.HealthInterval, config.FallbackProbeInterval, healthOptions)
+	}
+
+	err = serve(config.ServerAddr, r)
+
+	// Обработчики переходов уже завершились, поэтому канал можно закрыть и
+	// дождаться записи последней пачки
+	close(clickChan)
+	<-clicksDone
+	return err
+}
+
+// serve обслуживает запросы до SIGINT или SIGTERM, после чего даёт начатым
+// запросам завершиться.
+func serve(addr string, handler http.Handler) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := &http.Server{Addr: addr, Handler: handler}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Println("Остановка сервера")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
+}
+
+// routePrefixes возвращает постоянные первые сегменты маршрутов роутера и
+// постоянные сегменты, стоящие рядом с параметром, как broken рядом с
+// /api/user/urls/{id}: ссылка с таким алиасом была бы недоступна по API.
+func routePrefixes(r chi.Routes) []string {
+	seen := make(map[string]bool)
+	var prefixes []string
+	add := func(segment string) {
+		if !seen[segment] {
+			seen[segment] = true
+			prefixes = append(prefixes, segment)
+		}
+	}
+
+	params := make(map[string]bool)
+	statics := make(map[string][]string)
+	chi.Walk(r, func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		segments := strings.Split(strings.TrimPrefix(route, "/"), "/")
+		if first := segments[0]; first != "" && !strings.ContainsAny(first, "{*") {
+			add(first)
+		}
+		for i := 1; i < len(segments); i++ {
+			parent := strings.Join(segments[:i], "/")
+			switch segment := segments[i]; {
+			case strings.HasPrefix(segment, "{"):
+				params[parent] = true
+			case segment != "" && segment != "*":
+				statics[parent] = append(statics[parent], segment)
+			}
+		}
+		return nil
+	})
+
+	for parent, segments := range statics {
+		if params[parent] {
+			for _, segment := range segments {
+				add(segment)
+			}
+		}
+	}
+
+	return prefixes
 }
 
 func InitStorage(conf *config.Config) (repository.Storage, error) {
@@ -23,18 +23,24 @@ func TestRun(t *testing.T) {
 	}
 	fakeStorage := &repository.JSON{} // Замените на фейковое хранилище
 	deleteChan := make(chan repository.DeleteRequest, 100)
+	clickChan := make(chan repository.Click, 100)
+	enrichChan := make(chan repository.EnrichRequest, 100)
 	var wg sync.WaitGroup
+	generator, err := handlers.NewIDGenerator(fakeConfig, fakeStorage)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	// Создаем фейковый маршрутизатор
 	r := chi.NewRouter()
 
 	// Заменяем Post и Get обработчики на фейковые
 	r.Post("/", func(w http.ResponseWriter, r *http.Request) {
-		handlers.PostAddURL(w, r, fakeConfig, fakeStorage)
+		handlers.PostAddURL(w, r, fakeConfig, fakeStorage, generator, enrichChan)
 	})
 
 	r.Get("/{id}", func(w http.ResponseWriter, r *http.Request) {
-		handlers.GetByID(w, r, fakeConfig, fakeStorage)
+		handlers.GetByID(w, r, fakeConfig, fakeStorage, clickChan)
 	})
 
 	// Создаем тестовый сервер
@@ -43,12 +49,13 @@ func TestRun(t *testing.T) {
 
 	// Запускаем функцию Run в фоновом режиме
 	go func() {
-		err := Run(fakeConfig, fakeStorage, deleteChan, &wg)
+		err := Run(fakeConfig, fakeStorage, deleteChan, clickChan, enrichChan, &wg)
 		if err != nil {
 			t.Errorf("Ошибка при запуске сервера: %v", err)
 		}
 		wg.Wait()
 		close(deleteChan)
+		close(enrichChan)
 	}()
 
 	// Выполняем GET-запрос к серверу (замените "your-id" на реальный ID)
@@ -64,3 +71,28 @@ func TestRun(t *testing.T) {
 	}
 
 }
+
+func TestRoutePrefixes(t *testing.T) {
+	r := chi.NewRouter()
+	r.Get("/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	r.Get("/ping", func(w http.ResponseWriter, r *http.Request) {})
+	r.Post("/api/shorten", func(w http.ResponseWriter, r *http.Request) {})
+	r.Get("/api/user/urls", func(w http.ResponseWriter, r *http.Request) {})
+	r.Get("/api/user/urls/broken", func(w http.ResponseWriter, r *http.Request) {})
+	r.Get("/api/user/urls/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	r.Get("/api/user/urls/{id}/stats", func(w http.ResponseWriter, r *http.Request) {})
+
+	prefixes := routePrefixes(r)
+	if len(prefixes) != 3 {
+		t.Fatalf("Ожидалось 3 префикса, но получили %v", prefixes)
+	}
+	for _, want := range []string{"api", "ping", "broken"} {
+		found := false
+		for _, p := range prefixes {
+			found = found || p == want
+		}
+		if !found {
+			t.Errorf("Префикс %s не найден в %v", want, prefixes)
+		}
+	}
+}
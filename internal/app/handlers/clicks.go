@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"shortener/internal/app/handlers/service/repository"
+	"sync/atomic"
+	"time"
+)
+
+// droppedClicks считает события, не попавшие в переполненный канал.
+var droppedClicks atomic.Int64
+
+// emitClick отправляет событие перехода, не дожидаясь места в канале:
+// при переполнении событие теряется, а переход не задерживается.
+func emitClick(clickChan chan<- repository.Click, r *http.Request, item *repository.InMemoryStorage, variant int) {
+	if clickChan == nil {
+		return
+	}
+
+	click := repository.Click{
+		LinkID:    item.ID,
+		Time:      time.Now().UTC(),
+		Referrer:  r.Referer(),
+		UserAgent: r.UserAgent(),
+		IP:        anonymizeIP(remoteHost(r)),
+		Variant:   variant,
+	}
+	if variant >= 0 && variant < len(item.Destinations) {
+		click.Destination = item.Destinations[variant].URL
+	}
+
+	select {
+	case clickChan <- click:
+	default:
+		// В журнал попадает каждая тысячная потеря, чтобы не засорять его под нагрузкой
+		if n := droppedClicks.Add(1); n%1000 == 1 {
+			log.Printf("Канал переходов переполнен, потеряно событий: %d", n)
+		}
+	}
+}
+
+// anonymizeIP обнуляет последний октет IPv4 и всё после /48 у IPv6.
+func anonymizeIP(host string) string {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
@@ -0,0 +1,20 @@
+package handlers
+
+import (
+	"log"
+	"shortener/internal/app/handlers/service/repository"
+)
+
+// enqueueEnrich ставит ссылку в очередь на загрузку сведений о странице.
+// Очередь не ждёт: при переполнении ссылка останется без сведений.
+func enqueueEnrich(enrichChan chan<- repository.EnrichRequest, item *repository.InMemoryStorage) {
+	if enrichChan == nil {
+		return
+	}
+
+	select {
+	case enrichChan <- repository.EnrichRequest{ID: item.ID, LongURL: item.LongURL}:
+	default:
+		log.Printf("Очередь сведений о страницах переполнена, ссылка %s пропущена", item.ID)
+	}
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"shortener/internal/app/handlers/service/repository"
+	"shortener/internal/app/middleware"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const maxFallbacks = 5
+
+// validateFallbacks проверяет запасные адреса и приводит их к виду, в котором
+// они хранятся. Пустой список отключает запасные адреса.
+func validateFallbacks(fallbacks []string) ([]string, error) {
+	if len(fallbacks) > maxFallbacks {
+		return nil, fmt.Errorf("не больше %d запасных адресов", maxFallbacks)
+	}
+
+	seen := make(map[string]bool)
+	result := make([]string, 0, len(fallbacks))
+	for i, raw := range fallbacks {
+		longURL, err := parseURL(raw)
+		if err != nil {
+			return nil, fmt.Errorf("запасной адрес %d: некорректный адрес: %w", i+1, err)
+		}
+		if seen[longURL] {
+			return nil, fmt.Errorf("запасной адрес %d повторяется", i+1)
+		}
+		seen[longURL] = true
+		result = append(result, longURL)
+	}
+
+	return result, nil
+}
+
+// pickFallback возвращает первый запасной адрес, который не провалил проверку.
+// Ещё не проверенный адрес считается рабочим: лучше попробовать его, чем вести
+// на заведомо нерабочий основной.
+func pickFallback(item *repository.InMemoryStorage) (string, bool) {
+	for _, f := range item.Fallbacks {
+		if !f.Health.Broken() {
+			return f.URL, true
+		}
+	}
+	return "", false
+}
+
+// PutURLFallbacks заменяет запасные адреса ссылки пользователя. Тело — список адресов по порядку.
+func PutURLFallbacks(w http.ResponseWriter, r *http.Request, storage repository.Storage) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		fmt.Println("userID not found in context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	version, err := parseIfMatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var urls []string
+	if err := json.NewDecoder(r.Body).Decode(&urls); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	urls, err = validateFallbacks(urls)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fallbacks := repository.FallbackURLs(urls)
+	version, err = storage.SetFallbacks(chi.URLParam(r, "id"), userID, version, fallbacks)
+	if writeLinkError(w, err) {
+		return
+	}
+
+	if fallbacks == nil {
+		fallbacks = []repository.Fallback{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", formatETag(version))
+	json.NewEncoder(w).Encode(fallbacks)
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"shortener/internal/app/handlers/service/repository"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var (
+	errNoPathForwarding = errors.New("ссылка не передаёт путь")
+	errReservedPath     = errors.New("путь после идентификатора зарезервирован")
+)
+
+// destinationURL собирает адрес перехода: к выбранному адресу ссылки добавляются
+// путь после идентификатора и параметры запроса, если ссылка их передаёт.
+func destinationURL(r *http.Request, item *repository.InMemoryStorage, longURL string) (string, error) {
+	longURL = strings.TrimSpace(longURL)
+
+	rest := chi.URLParam(r, "*")
+	if rest != "" && !item.ForwardPath {
+		return "", errNoPathForwarding
+	}
+	// /{id}/qr отдаёт QR-код, поэтому этот путь не передаётся и через POST из формы пароля
+	if rest == qrPath {
+		return "", errReservedPath
+	}
+	forwardQuery := item.ForwardQuery && r.URL.RawQuery != ""
+	if rest == "" && !forwardQuery {
+		return longURL, nil
+	}
+
+	target, err := url.Parse(longURL)
+	if err != nil {
+		return "", err
+	}
+
+	if rest != "" {
+		target.Path = joinPath(target.Path, rest)
+		target.RawPath = ""
+	}
+
+	if forwardQuery {
+		target.RawQuery = mergeQuery(target.RawQuery, r.URL.Query())
+	}
+
+	return target.String(), nil
+}
+
+// joinPath дописывает путь запроса к пути адреса ссылки. Путь очищается от
+// "..", чтобы переход не выходил за пределы пути ссылки.
+func joinPath(base, rest string) string {
+	if unescaped, err := url.PathUnescape(rest); err == nil {
+		rest = unescaped
+	}
+
+	joined := strings.TrimSuffix(base, "/") + path.Clean("/"+rest)
+	if strings.HasSuffix(rest, "/") && !strings.HasSuffix(joined, "/") {
+		joined += "/"
+	}
+	return joined
+}
+
+// mergeQuery добавляет к запросу адреса ссылки параметры входящего запроса.
+// Параметры, заданные в самой ссылке, не переопределяются.
+func mergeQuery(rawQuery string, incoming url.Values) string {
+	own, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		own = url.Values{}
+	}
+
+	extra := url.Values{}
+	for key, values := range incoming {
+		if _, ok := own[key]; !ok {
+			extra[key] = values
+		}
+	}
+
+	switch {
+	case len(extra) == 0:
+		return rawQuery
+	case rawQuery == "":
+		return extra.Encode()
+	}
+	return rawQuery + "&" + extra.Encode()
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-chi/chi/v5"
 	_ "github.com/lib/pq"
@@ -13,13 +14,17 @@ import (
 	"shortener/internal/app/handlers/service/repository"
 	"shortener/internal/app/middleware"
 	"shortener/internal/config"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type ShortenRequest struct {
 	CorrelationID string `json:"correlation_id"`
 	OriginalURL   string `json:"original_url"`
+	Alias         string `json:"alias,omitempty"`
+	LinkOptions
 }
 
 type ShortenResponse struct {
@@ -27,7 +32,86 @@ type ShortenResponse struct {
 	ShortURL      string `json:"short_url"`
 }
 
-func PostAddURL(w http.ResponseWriter, r *http.Request, config *config.Config, storage repository.Storage) {
+// parseURL проверяет адрес, присланный для сокращения, и возвращает его
+// в раскодированном виде.
+func parseURL(raw string) (string, error) {
+	sit, err := url.ParseRequestURI(raw)
+	if err != nil {
+		return "", err
+	}
+
+	return url.PathUnescape(sit.String())
+}
+
+// maxIDAttempts ограничивает число попыток подобрать свободный идентификатор.
+const maxIDAttempts = 5
+
+var errNoFreeID = errors.New("не удалось подобрать свободный идентификатор")
+
+// NewIDGenerator создаёт генератор идентификаторов, выбранный в конфигурации.
+func NewIDGenerator(config *config.Config, storage repository.Storage) (internal.IDGenerator, error) {
+	return internal.NewIDGenerator(internal.GeneratorOptions{
+		Kind:        config.IDGenerator,
+		Length:      config.IDLength,
+		HashKey:     config.IDHashKey,
+		HashPerUser: config.IDHashPerUser,
+		Sequence:    storage,
+		Filter:      newSlugFilter(config),
+	})
+}
+
+// newSlugFilter собирает фильтр идентификаторов и алиасов из путей сервиса и списка запрещённых слов.
+func newSlugFilter(config *config.Config) *internal.SlugFilter {
+	denied := config.DenyList
+	if len(denied) == 0 {
+		denied = internal.DefaultDenied
+	}
+
+	reserved := append(append([]string(nil), internal.DefaultReserved...), config.ReservedPaths...)
+	return internal.NewSlugFilter(reserved, denied)
+}
+
+// saveWithNewID сохраняет ссылку под новым идентификатором и генерирует другой,
+// если хранилище сообщает о коллизии. Возвращает короткий URL уже сокращённого адреса.
+func saveWithNewID(storage repository.Storage, generator internal.IDGenerator, baseURL string, item *repository.InMemoryStorage) (string, error) {
+	for attempt := 0; attempt < maxIDAttempts; attempt++ {
+		id, err := generator.Generate(item.LongURL, item.UserID, attempt)
+		if err != nil {
+			return "", err
+		}
+
+		item.ID = id
+		item.ShortURL = baseURL + "/" + id
+
+		short, err := storage.SaveURL(item)
+		if errors.Is(err, repository.ErrIDCollision) {
+			// Детерминированный генератор повторно выдаёт идентификатор уже сокращённого адреса
+			existing, getErr := storage.GetURL(id)
+			if getErr == nil && internal.NormalizeURL(existing.LongURL) == internal.NormalizeURL(item.LongURL) {
+				return existing.ShortURL, nil
+			}
+
+			log.Printf("идентификатор %s уже занят, попытка %d", id, attempt+1)
+			continue
+		}
+		return short, err
+	}
+
+	return "", errNoFreeID
+}
+
+// saveLink сохраняет ссылку под алиасом пользователя, а без него — под новым идентификатором.
+func saveLink(storage repository.Storage, generator internal.IDGenerator, baseURL, alias string, item *repository.InMemoryStorage) (string, error) {
+	if alias == "" {
+		return saveWithNewID(storage, generator, baseURL, item)
+	}
+
+	item.ID = alias
+	item.ShortURL = baseURL + "/" + alias
+	return storage.SaveURL(item)
+}
+
+func PostAddURL(w http.ResponseWriter, r *http.Request, config *config.Config, storage repository.Storage, generator internal.IDGenerator, enrichChan chan<- repository.EnrichRequest) {
 
 	var userID string
 
@@ -47,68 +131,155 @@ func PostAddURL(w http.ResponseWriter, r *http.Request, config *config.Config, s
 
 	defer r.Body.Close()
 
-	sit, err := url.ParseRequestURI(string(body))
+	sitr, err := parseURL(string(body))
 	if err != nil {
 		fmt.Println("URL is not valid", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	s := sit.String()
-	sitr, err := url.PathUnescape(s)
-	if err != nil {
-		fmt.Println(err, sitr)
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	newItem := repository.InMemoryStorage{
+		LongURL: sitr,
+		UserID:  userID,
+		Flag:    false,
 	}
 
-	id := internal.GenerateRandomString(10)
-	shortURL := config.BaseURL + "/" + id
-
-	newItem := repository.InMemoryStorage{
-		ID:       id,
-		LongURL:  sitr,
-		ShortURL: shortURL,
-		UserID:   userID,
-		Flag:     false,
+	// Тело — сам адрес, поэтому настройки ссылки передаются в параметрах запроса
+	if err := linkOptionsFromRequest(r).apply(&newItem, config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	short, err := storage.SaveURL(&newItem)
+	short, err := saveWithNewID(storage, generator, config.BaseURL, &newItem)
 	if err != nil {
 		log.Println("Ошибка сохранения url", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 	if short != "" {
 		w.WriteHeader(http.StatusConflict)
 		w.Write([]byte(short))
 	} else {
+		enqueueEnrich(enrichChan, &newItem)
 		w.WriteHeader(http.StatusCreated)
-		w.Write([]byte(shortURL))
+		w.Write([]byte(newItem.ShortURL))
 	}
 
 }
 
-func GetByID(w http.ResponseWriter, r *http.Request, config *config.Config, storage repository.Storage) {
+func GetByID(w http.ResponseWriter, r *http.Request, config *config.Config, storage repository.Storage, clickChan chan<- repository.Click) {
+	item, ok := activeLink(w, r, config, storage)
+	if !ok {
+		return
+	}
+
+	// Ссылка с паролем открывается только через форму
+	if item.PasswordHash != "" {
+		renderPasswordForm(w, http.StatusOK, "")
+		return
+	}
+
+	followLink(w, r, config, storage, clickChan, item, redirectCode(item, config))
+}
+
+// redirectCode возвращает код перенаправления ссылки, а для ссылок без него — код по умолчанию.
+func redirectCode(item *repository.InMemoryStorage, config *config.Config) int {
+	if item.RedirectCode != 0 {
+		return item.RedirectCode
+	}
+	if config.RedirectCode != 0 {
+		return config.RedirectCode
+	}
+	return http.StatusTemporaryRedirect
+}
+
+// activeLink находит ссылку из пути запроса. Если перейти по ней нельзя,
+// отвечает сам и возвращает false.
+func activeLink(w http.ResponseWriter, r *http.Request, config *config.Config, storage repository.Storage) (*repository.InMemoryStorage, bool) {
 	id := chi.URLParam(r, "id")
 
-	long, flag, _ := storage.GetLongURL(id)
-	Location := strings.TrimSpace(long)
-	w.Header().Set("Location", long)
+	item, err := storage.GetURL(id)
+	if err != nil || strings.TrimSpace(item.LongURL) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, false
+	}
 
-	if Location != "" && !flag {
-		http.Redirect(w, r, Location, http.StatusTemporaryRedirect)
-		return
-	} else if Location != "" && flag {
+	// Истёкшая ссылка отвечает так же, как удалённая; срок сверяется сам, без пометки ExpireHandler
+	now := time.Now()
+	if item.Flag || item.Expired(now) || item.Ended(now) {
 		w.WriteHeader(http.StatusGone)
+		return nil, false
+	}
+
+	if item.Scheduled(now) {
+		writePending(w, r, config, item, now)
+		return nil, false
+	}
+
+	return item, true
+}
+
+// writePending отвечает на переход по ссылке, окно которой ещё не открылось:
+// ведёт на запасной адрес ссылки или сервера, а без него сообщает, когда приходить.
+func writePending(w http.ResponseWriter, r *http.Request, config *config.Config, item *repository.InMemoryStorage, now time.Time) {
+	pendingURL := item.PendingURL
+	if pendingURL == "" {
+		pendingURL = config.PendingURL
+	}
+	if pendingURL != "" {
+		// Временный код, чтобы браузер не запомнил запасной адрес после запуска
+		http.Redirect(w, r, pendingURL, http.StatusFound)
 		return
-	} else {
-		w.WriteHeader(http.StatusBadRequest)
+	}
+
+	// Retry-After учитывается клиентами только вместе с 503
+	w.Header().Set("Retry-After", strconv.Itoa(int(item.ActiveFrom.Sub(now).Seconds())+1))
+	http.Error(w, config.PendingMessage, http.StatusServiceUnavailable)
+}
+
+// followLink списывает переход, если их число ограничено, и перенаправляет на адрес ссылки.
+func followLink(w http.ResponseWriter, r *http.Request, config *config.Config, storage repository.Storage, clickChan chan<- repository.Click, item *repository.InMemoryStorage, code int) {
+	longURL, variant := pickDestination(w, r, item, config.GeoHeader)
+	if longURL == item.LongURL && item.Health.Broken() {
+		if fallback, ok := pickFallback(item); ok {
+			longURL = fallback
+		}
+	}
+	destination, err := destinationURL(r, item, longURL)
+	if errors.Is(err, errNoPathForwarding) || errors.Is(err, errReservedPath) {
+		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	if err != nil {
+		log.Println("Ошибка сборки адреса перехода", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Переход списывается только перед самим редиректом
+	if item.ClicksLeft != nil {
+		err := storage.ConsumeClick(item.ID)
+		if errors.Is(err, repository.ErrExhausted) {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		if err != nil {
+			log.Println("Ошибка списания перехода", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Вариант учитывается из события перехода в ClickHandler, чтобы не ждать записи
+	emitClick(clickChan, r, item, variant)
+	http.Redirect(w, r, destination, code)
 }
 
-func PostAPIShorten(w http.ResponseWriter, r *http.Request, config *config.Config, storage repository.Storage) {
+func PostAPIShorten(w http.ResponseWriter, r *http.Request, config *config.Config, storage repository.Storage, generator internal.IDGenerator, enrichChan chan<- repository.EnrichRequest) {
 	var requestData struct {
-		URL string `json:"url"`
+		URL   string `json:"url"`
+		Alias string `json:"alias,omitempty"`
+		LinkOptions
 	}
 
 	var userID string
@@ -142,28 +313,45 @@ func PostAPIShorten(w http.ResponseWriter, r *http.Request, config *config.Confi
 		return
 	}
 
-	// Назначаем случайный id
-	id := internal.GenerateRandomString(10)
-	respoID := config.BaseURL + "/" + id
+	if requestData.Alias != "" {
+		if err := internal.ValidateAlias(requestData.Alias, newSlugFilter(config)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
 	newItem := repository.InMemoryStorage{
-		ID:       id,
-		LongURL:  requestData.URL,
-		ShortURL: respoID,
-		UserID:   userID,
-		Flag:     false,
+		LongURL: requestData.URL,
+		UserID:  userID,
+		Flag:    false,
+	}
+
+	if err := requestData.LinkOptions.apply(&newItem, config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	storage.SaveURL(&newItem)
+	// Назначаем алиас или случайный id
+	short, err := saveLink(storage, generator, config.BaseURL, requestData.Alias, &newItem)
+	if errors.Is(err, repository.ErrIDCollision) {
+		http.Error(w, "Алиас уже занят", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Println("Ошибка сохранения url", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	respoID := newItem.ShortURL
 
-	short, _ := storage.SaveURL(&newItem)
 	if short != "" {
-		response := map[string]string{"result": short}
+		response := map[string]string{"result": short, "qr": qrURL(short)}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusConflict)
 		json.NewEncoder(w).Encode(response)
 	} else {
-		response := map[string]string{"result": respoID}
+		enqueueEnrich(enrichChan, &newItem)
+		response := map[string]string{"result": respoID, "qr": qrURL(respoID)}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
 		json.NewEncoder(w).Encode(response)
@@ -171,7 +359,7 @@ func PostAPIShorten(w http.ResponseWriter, r *http.Request, config *config.Confi
 
 }
 
-func GetUrlsHandler(w http.ResponseWriter, r *http.Request) {
+func GetUrlsHandler(w http.ResponseWriter, r *http.Request, storage repository.Storage) {
 	var userID string
 
 	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
@@ -181,7 +369,7 @@ func GetUrlsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	urls, err := repository.FindURL(userID)
+	urls, err := storage.GetUserURLs(userID)
 	if err != nil {
 		http.Error(w, "Не удалось получить список URL пользователя", http.StatusInternalServerError)
 		return
@@ -202,6 +390,38 @@ func GetUrlsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(jsonResult)
 }
 
+// GetBrokenURLs отдаёт ссылки пользователя, у которых основной адрес, адрес правила
+// или варианта A/B-теста не прошёл последнюю проверку.
+func GetBrokenURLs(w http.ResponseWriter, r *http.Request, storage repository.Storage) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		fmt.Println("userID not found in context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	urls, err := storage.GetUserURLs(userID)
+	if err != nil {
+		http.Error(w, "Не удалось получить список URL пользователя", http.StatusInternalServerError)
+		return
+	}
+
+	broken := make([]repository.Rez, 0, len(urls))
+	for _, u := range urls {
+		if u.BrokenTarget() {
+			broken = append(broken, u)
+		}
+	}
+
+	if len(broken) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(broken)
+}
+
 func PingDB(w http.ResponseWriter, r *http.Request, config *config.Config, storage repository.Storage) {
 	err := storage.Ping(config)
 	if err != nil {
@@ -213,7 +433,7 @@ func PingDB(w http.ResponseWriter, r *http.Request, config *config.Config, stora
 	w.WriteHeader(http.StatusOK)
 }
 
-func PostBatch(w http.ResponseWriter, r *http.Request, config *config.Config, storage repository.Storage) {
+func PostBatch(w http.ResponseWriter, r *http.Request, config *config.Config, storage repository.Storage, generator internal.IDGenerator, enrichChan chan<- repository.EnrichRequest) {
 	var requests []ShortenRequest
 
 	defer r.Body.Close()
@@ -231,30 +451,69 @@ func PostBatch(w http.ResponseWriter, r *http.Request, config *config.Config, st
 		return
 	}
 
+	// Алиасы и настройки проверяются до сохранения, чтобы не записать пакет наполовину
+	filter := newSlugFilter(config)
+	aliases := make(map[string]bool)
+	items := make([]repository.InMemoryStorage, len(requests))
+	for i, req := range requests {
+		items[i] = repository.InMemoryStorage{
+			LongURL: req.OriginalURL,
+			UserID:  userID,
+		}
+		if err := req.LinkOptions.apply(&items[i], config); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if req.Alias == "" {
+			continue
+		}
+		if err := internal.ValidateAlias(req.Alias, filter); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		key := strings.ToLower(req.Alias)
+		if aliases[key] {
+			http.Error(w, "Алиас "+req.Alias+" повторяется в запросе", http.StatusBadRequest)
+			return
+		}
+		aliases[key] = true
+
+		if _, err := storage.GetURL(req.Alias); err == nil {
+			http.Error(w, "Алиас "+req.Alias+" уже занят", http.StatusConflict)
+			return
+		}
+	}
+
 	var responses []ShortenResponse
 
-	for _, req := range requests {
+	for i, req := range requests {
+
+		newURL := items[i]
 
-		id := internal.GenerateRandomString(10)
-		short := config.BaseURL + "/" + id
+		short, err := saveLink(storage, generator, config.BaseURL, req.Alias, &newURL)
+		if errors.Is(err, repository.ErrIDCollision) {
+			http.Error(w, "Алиас "+req.Alias+" уже занят", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Ошибка сохранения url %s: %s", newURL.LongURL, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if short == "" {
+			short = newURL.ShortURL
+			enqueueEnrich(enrichChan, &newURL)
+		} else {
+			log.Printf("ссылка %s есть в базе", newURL.LongURL)
+		}
 
 		responses = append(responses, ShortenResponse{
 			CorrelationID: req.CorrelationID,
 			ShortURL:      short,
 		})
 
-		newURL := repository.InMemoryStorage{
-			ID:       id,
-			LongURL:  req.OriginalURL,
-			ShortURL: short,
-			UserID:   userID,
-		}
-
-		if _, err := storage.SaveURL(&newURL); err != nil {
-			log.Printf("ссылка %s есть в базе", newURL.LongURL)
-
-		}
-
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -285,3 +544,229 @@ func Delete(w http.ResponseWriter, r *http.Request, storage repository.Storage,
 	w.WriteHeader(http.StatusAccepted)
 
 }
+
+// parseIfMatch возвращает версию записи из заголовка If-Match; 0 — заголовка нет.
+func parseIfMatch(r *http.Request) (int64, error) {
+	etag := strings.TrimSpace(r.Header.Get("If-Match"))
+	if etag == "" || etag == "*" {
+		return 0, nil
+	}
+
+	etag = strings.Trim(strings.TrimPrefix(etag, "W/"), `"`)
+	version, err := strconv.ParseInt(etag, 10, 64)
+	if err != nil || version <= 0 {
+		return 0, fmt.Errorf("некорректный If-Match: %q", etag)
+	}
+	return version, nil
+}
+
+func formatETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// writeLinkError отвечает на ошибку изменения ссылки и сообщает, была ли ошибка.
+func writeLinkError(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, repository.ErrNotFound):
+		http.Error(w, "URL не найден", http.StatusNotFound)
+	case errors.Is(err, repository.ErrDeleted):
+		w.WriteHeader(http.StatusGone)
+	case errors.Is(err, repository.ErrVersionMismatch):
+		http.Error(w, "Запись изменена другим запросом", http.StatusPreconditionFailed)
+	default:
+		log.Println("Ошибка изменения url", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	return true
+}
+
+func PatchURL(w http.ResponseWriter, r *http.Request, storage repository.Storage, enrichChan chan<- repository.EnrichRequest) {
+	var requestData struct {
+		URL string `json:"url"`
+	}
+
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		fmt.Println("userID not found in context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+
+	version, err := parseIfMatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = json.NewDecoder(r.Body).Decode(&requestData)
+	if err != nil || requestData.URL == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	longURL, err := parseURL(requestData.URL)
+	if err != nil {
+		fmt.Println("URL is not valid", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	item := repository.InMemoryStorage{ID: id, LongURL: longURL, UserID: userID, Version: version}
+	short, err := storage.UpdateURL(&item)
+	if err == nil && short == "" {
+		enqueueEnrich(enrichChan, &item)
+	}
+	writeUpdateResult(w, &item, short, err)
+}
+
+// writeUpdateResult отвечает на смену адреса назначения ссылки.
+func writeUpdateResult(w http.ResponseWriter, item *repository.InMemoryStorage, short string, err error) {
+	if writeLinkError(w, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if short != "" {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"result": short})
+		return
+	}
+
+	w.Header().Set("ETag", formatETag(item.Version))
+	json.NewEncoder(w).Encode(repository.Rez{
+		ShortURL: item.ShortURL,
+		LongURL:  item.LongURL,
+		Version:  item.Version,
+	})
+}
+
+func GetUserURL(w http.ResponseWriter, r *http.Request, storage repository.Storage) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		fmt.Println("userID not found in context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	item, err := storage.GetURL(chi.URLParam(r, "id"))
+	if err == nil && item.UserID != userID {
+		err = repository.ErrNotFound
+	}
+	if writeLinkError(w, err) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", formatETag(item.Version))
+	json.NewEncoder(w).Encode(repository.Rez{
+		ShortURL: item.ShortURL,
+		LongURL:  item.LongURL,
+		Version:  item.Version,
+	})
+}
+
+func DeleteByID(w http.ResponseWriter, r *http.Request, storage repository.Storage) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		fmt.Println("userID not found in context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	version, err := parseIfMatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = storage.DeleteByID(chi.URLParam(r, "id"), userID, version)
+	if writeLinkError(w, err) {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func GetURLHistory(w http.ResponseWriter, r *http.Request, storage repository.Storage) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		fmt.Println("userID not found in context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	history, err := storage.GetHistory(chi.URLParam(r, "id"), userID)
+	if errors.Is(err, repository.ErrNotFound) {
+		http.Error(w, "URL не найден", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Ошибка получения истории url", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+func RollbackURL(w http.ResponseWriter, r *http.Request, storage repository.Storage, enrichChan chan<- repository.EnrichRequest) {
+	var requestData struct {
+		Version int `json:"version"`
+	}
+
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		fmt.Println("userID not found in context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	id := chi.URLParam(r, "id")
+
+	version, err := parseIfMatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	history, err := storage.GetHistory(id, userID)
+	if errors.Is(err, repository.ErrNotFound) {
+		http.Error(w, "URL не найден", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Ошибка получения истории url", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var longURL string
+	for _, rev := range history {
+		if rev.Version == requestData.Version {
+			longURL = rev.LongURL
+			break
+		}
+	}
+	if longURL == "" {
+		http.Error(w, "Версия не найдена", http.StatusBadRequest)
+		return
+	}
+
+	// Откат — обычная смена адреса, поэтому он тоже попадает в историю
+	item := repository.InMemoryStorage{ID: id, LongURL: longURL, UserID: userID, Version: version}
+	short, err := storage.UpdateURL(&item)
+	if err == nil && short == "" {
+		enqueueEnrich(enrichChan, &item)
+	}
+	writeUpdateResult(w, &item, short, err)
+}
@@ -2,14 +2,25 @@ package handlers
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"shortener/internal"
 	"shortener/internal/app/handlers/service/repository"
 	"shortener/internal/app/middleware"
 	"shortener/internal/config"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi"
+	chiv5 "github.com/go-chi/chi/v5"
 )
 
 func TestPostAddURL(t *testing.T) {
@@ -39,11 +50,15 @@ func TestPostAddURL(t *testing.T) {
 	// Замените это на создание фейковых объектов конфига и хранилища
 	config := &config.Config{}
 	storage := &repository.JSON{}
+	generator, err := NewIDGenerator(config, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	// Вызываем тестируемую функцию
 	r.Use(middleware.SetUserIDCookie)
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		PostAddURL(w, r, config, storage)
+		PostAddURL(w, r, config, storage, generator, nil)
 	})
 	r.Post("/", handler)
 
@@ -55,4 +70,601 @@ func TestPostAddURL(t *testing.T) {
 		t.Errorf("Ожидался статус %d, но получили %d", http.StatusCreated, status)
 	}
 
+	// Нераспознанный флаг отклоняется, а не превращается молча в false
+	req = httptest.NewRequest(http.MethodPost, "/?forward_path=yes", bytes.NewBufferString("https://example.com/other"))
+	req.AddCookie(cookie)
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("Ожидался статус %d, но получили %d", http.StatusBadRequest, status)
+	}
+}
+
+func TestParseIfMatch(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPatch, "/api/user/urls/abc", nil)
+
+	if version, err := parseIfMatch(req); err != nil || version != 0 {
+		t.Errorf("Без заголовка ожидалась версия 0, получили %d, %v", version, err)
+	}
+
+	req.Header.Set("If-Match", `W/"7"`)
+	if version, err := parseIfMatch(req); err != nil || version != 7 {
+		t.Errorf("Ожидалась версия 7, получили %d, %v", version, err)
+	}
+
+	req.Header.Set("If-Match", `"abc"`)
+	if _, err := parseIfMatch(req); err == nil {
+		t.Error("Ожидалась ошибка для некорректного If-Match")
+	}
+}
+
+// fixedGenerator выдаёт заранее заданные идентификаторы, повторяя последний.
+type fixedGenerator struct {
+	ids []string
+}
+
+func (g *fixedGenerator) Generate(_, _ string, _ int) (string, error) {
+	id := g.ids[0]
+	if len(g.ids) > 1 {
+		g.ids = g.ids[1:]
+	}
+	return id, nil
+}
+
+func TestSaveWithNewIDRetriesOnCollision(t *testing.T) {
+	storage := &repository.JSON{}
+	storage.SaveURL(&repository.InMemoryStorage{ID: "taken1", LongURL: "https://collision-one.com", UserID: "u1"})
+
+	generator := &fixedGenerator{ids: []string{"TAKEN1", "taken1", "free01"}}
+	item := repository.InMemoryStorage{LongURL: "https://collision-two.com", UserID: "u1"}
+
+	short, err := saveWithNewID(storage, generator, "http://localhost", &item)
+	if err != nil || short != "" {
+		t.Fatalf("Ожидалось успешное сохранение, получили %q, %v", short, err)
+	}
+	if item.ID != "free01" || item.ShortURL != "http://localhost/free01" {
+		t.Errorf("Ожидался идентификатор free01, но получили %s (%s)", item.ID, item.ShortURL)
+	}
+}
+
+func TestSaveWithNewIDGivesUp(t *testing.T) {
+	storage := &repository.JSON{}
+	storage.SaveURL(&repository.InMemoryStorage{ID: "taken2", LongURL: "https://collision-three.com", UserID: "u1"})
+
+	generator := &fixedGenerator{ids: []string{"taken2"}}
+	item := repository.InMemoryStorage{LongURL: "https://collision-four.com", UserID: "u1"}
+
+	if _, err := saveWithNewID(storage, generator, "http://localhost", &item); !errors.Is(err, errNoFreeID) {
+		t.Errorf("Ожидалась ошибка errNoFreeID, получили %v", err)
+	}
+}
+
+func TestSaveWithNewIDHashReturnsExisting(t *testing.T) {
+	storage := &repository.JSON{}
+	generator, err := NewIDGenerator(&config.Config{IDGenerator: "hash", IDHashKey: "secret"}, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := repository.InMemoryStorage{LongURL: "https://hash-dedupe.com/page", UserID: "u1"}
+	if short, err := saveWithNewID(storage, generator, "http://localhost", &first); err != nil || short != "" {
+		t.Fatalf("Ожидалось успешное сохранение, получили %q, %v", short, err)
+	}
+
+	second := repository.InMemoryStorage{LongURL: "https://HASH-dedupe.com/page", UserID: "u2"}
+	short, err := saveWithNewID(storage, generator, "http://localhost", &second)
+	if err != nil || short != first.ShortURL {
+		t.Errorf("Ожидалась существующая ссылка %s, получили %q, %v", first.ShortURL, short, err)
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+	if expiry, err := parseExpiry("", ""); err != nil || expiry != nil {
+		t.Errorf("Без срока ожидалась бессрочная ссылка, получили %v, %v", expiry, err)
+	}
+
+	expiry, err := parseExpiry("", "2h")
+	if err != nil || expiry == nil || expiry.Before(time.Now().Add(time.Hour)) {
+		t.Errorf("Ожидался срок через 2 часа, получили %v, %v", expiry, err)
+	}
+
+	if _, err := parseExpiry("2000-01-01T00:00:00Z", ""); err == nil {
+		t.Error("Ожидалась ошибка для прошедшего момента")
+	}
+	if _, err := parseExpiry("2100-01-01T00:00:00Z", "1h"); err == nil {
+		t.Error("Ожидалась ошибка, когда указаны оба поля")
+	}
+}
+
+func TestAttemptLimiter(t *testing.T) {
+	limiter := newAttemptLimiter(2, time.Minute)
+	now := time.Now()
+
+	limiter.Attempt("key", now)
+	limiter.Attempt("key", now)
+	if ok, wait := limiter.Attempt("key", now.Add(time.Second)); ok || wait <= 0 {
+		t.Errorf("Ожидалась блокировка после двух попыток, получили %v, %v", ok, wait)
+	}
+	if ok, _ := limiter.Attempt("other", now); !ok {
+		t.Error("Блокировка не должна касаться другого ключа")
+	}
+	if ok, _ := limiter.Attempt("key", now.Add(time.Minute)); !ok {
+		t.Error("Ожидалось снятие блокировки после окна")
+	}
+
+	limiter.Reset("key")
+	if ok, _ := limiter.Attempt("key", now); !ok {
+		t.Error("Ожидалось снятие блокировки после успешного входа")
+	}
+}
+
+func TestPostPasswordConcurrentGuesses(t *testing.T) {
+	hash, err := internal.HashPassword("secret")
+	if err != nil {
+		t.Fatalf("Ошибка хэширования: %v", err)
+	}
+	storage := &repository.JSON{}
+	storage.SaveURL(&repository.InMemoryStorage{ID: "guessID", LongURL: "https://guess.com", UserID: "u1", PasswordHash: hash})
+
+	var checks atomic.Int64
+	checkPassword = func(hash, password string) (bool, error) {
+		checks.Add(1)
+		// Медленная проверка оставляет время остальным запросам
+		time.Sleep(20 * time.Millisecond)
+		return false, nil
+	}
+	defer func() { checkPassword = internal.CheckPassword }()
+
+	router := chiv5.NewRouter()
+	router.Post("/{id}", func(w http.ResponseWriter, r *http.Request) {
+		PostPassword(w, r, &config.Config{}, storage, nil)
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4*maxPasswordAttempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodPost, "/guessID", strings.NewReader("password=wrong"))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			router.ServeHTTP(httptest.NewRecorder(), r)
+		}()
+	}
+	wg.Wait()
+
+	if n := checks.Load(); n > maxPasswordAttempts {
+		t.Errorf("До проверки пароля дошло %d запросов, лимит %d", n, maxPasswordAttempts)
+	}
+}
+
+func TestRedirectCodeOption(t *testing.T) {
+	cfg := config.NewConfigBuilder().RedirectCode(http.StatusFound).Build()
+
+	var item repository.InMemoryStorage
+	if err := (LinkOptions{}).apply(&item, cfg); err != nil || redirectCode(&item, cfg) != http.StatusFound {
+		t.Errorf("Ожидался код по умолчанию 302, получили %d, %v", item.RedirectCode, err)
+	}
+
+	if err := (LinkOptions{RedirectCode: http.StatusPermanentRedirect}).apply(&item, cfg); err != nil || redirectCode(&item, cfg) != http.StatusPermanentRedirect {
+		t.Errorf("Ожидался выбранный код 308, получили %d, %v", item.RedirectCode, err)
+	}
+
+	if err := (LinkOptions{RedirectCode: http.StatusOK}).apply(&item, cfg); err == nil {
+		t.Error("Ожидалась ошибка для кода 200")
+	}
+}
+
+func TestForwarding(t *testing.T) {
+	if got := joinPath("/docs/", "guide/../../intro/"); got != "/docs/intro/" {
+		t.Errorf("Ожидался путь /docs/intro/, получили %s", got)
+	}
+
+	incoming := url.Values{"utm_source": {"mail"}, "ref": {"x"}}
+	if got := mergeQuery("ref=own", incoming); got != "ref=own&utm_source=mail" {
+		t.Errorf("Параметры ссылки не должны переопределяться, получили %s", got)
+	}
+	if got := mergeQuery("", url.Values{"q": {"a b"}}); got != "q=a+b" {
+		t.Errorf("Ожидался запрос q=a+b, получили %s", got)
+	}
+}
+
+func TestQRPathPrecedence(t *testing.T) {
+	cfg := config.NewConfigBuilder().QR(256, "M", 4).Build()
+	storage := &repository.JSON{}
+	storage.SaveURL(&repository.InMemoryStorage{ID: "qrFwd", LongURL: "https://docs.com/base", ShortURL: "http://localhost/qrFwd", UserID: "u1", ForwardPath: true})
+
+	router := chiv5.NewRouter()
+	router.Get("/{id}/qr", func(w http.ResponseWriter, r *http.Request) {
+		GetQR(w, r, cfg, storage)
+	})
+	router.Get("/{id}/*", func(w http.ResponseWriter, r *http.Request) {
+		GetByID(w, r, cfg, storage, nil)
+	})
+	router.Post("/{id}/*", func(w http.ResponseWriter, r *http.Request) {
+		PostPassword(w, r, cfg, storage, nil)
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/qrFwd/qr", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("/qr должен отдавать QR-код, получили %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/qrFwd/guide", nil))
+	if got := w.Header().Get("Location"); got != "https://docs.com/base/guide" {
+		t.Errorf("Ожидался переход на https://docs.com/base/guide, получили %d %s", w.Code, got)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/qrFwd/qr", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Путь qr не должен передаваться ссылке, получили %d", w.Code)
+	}
+}
+
+func TestPickDestination(t *testing.T) {
+	item := &repository.InMemoryStorage{
+		LongURL: "https://example.com",
+		Rules: []repository.Rule{
+			{Platform: "ios", Country: "de", URL: "https://apps.apple.com/de"},
+			{Platform: "android", URL: "https://play.google.com"},
+			{Language: "ru", URL: "https://example.com/ru"},
+		},
+	}
+	if err := validateRules(item.Rules); err != nil {
+		t.Fatalf("Правила должны быть корректными: %v", err)
+	}
+
+	cases := []struct {
+		ua, lang, country, want string
+	}{
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X)", "", "DE", "https://apps.apple.com/de"},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X)", "ru-RU", "FR", "https://example.com/ru"},
+		{"Mozilla/5.0 (Linux; Android 14)", "ru", "", "https://play.google.com"},
+		{"Mozilla/5.0 (Windows NT 10.0)", "en-US,ru;q=0.9", "", "https://example.com"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/id", nil)
+		r.Header.Set("User-Agent", c.ua)
+		r.Header.Set("Accept-Language", c.lang)
+		r.Header.Set("X-Country-Code", c.country)
+		w := httptest.NewRecorder()
+		if got, _ := pickDestination(w, r, item, "X-Country-Code"); got != c.want {
+			t.Errorf("%s, %s, %s: ожидался %s, получили %s", c.ua, c.lang, c.country, c.want, got)
+		}
+		if vary := w.Header().Get("Vary"); vary != "User-Agent, Accept-Language, X-Country-Code" {
+			t.Errorf("Ожидался Vary по заголовкам правил, получили %q", vary)
+		}
+	}
+	w := httptest.NewRecorder()
+	pickDestination(w, httptest.NewRequest(http.MethodGet, "/id", nil), &repository.InMemoryStorage{LongURL: "https://example.com"}, "X-Country-Code")
+	if vary := w.Header().Get("Vary"); vary != "" {
+		t.Errorf("Без правил Vary не нужен, получили %q", vary)
+	}
+
+	if err := validateRules([]repository.Rule{{URL: "https://example.com"}}); err == nil {
+		t.Error("Ожидалась ошибка для правила без условий")
+	}
+
+	// Проверку адреса нельзя прислать в теле запроса
+	rules := []repository.Rule{{Platform: "ios", URL: "https://example.com", Health: &repository.Health{Healthy: true}}}
+	if err := validateRules(rules); err != nil || rules[0].Health != nil {
+		t.Errorf("Присланная проверка правила должна сбрасываться, получили %+v, %v", rules[0].Health, err)
+	}
+	destinations := []repository.Destination{
+		{URL: "https://a.example.com", Weight: 1, Clicks: 9, Health: &repository.Health{}},
+		{URL: "https://b.example.com", Weight: 1},
+	}
+	if err := validateDestinations(destinations); err != nil || destinations[0].Health != nil || destinations[0].Clicks != 0 {
+		t.Errorf("Присланные счётчик и проверка варианта должны сбрасываться, получили %+v, %v", destinations[0], err)
+	}
+}
+
+func TestWeightedChoice(t *testing.T) {
+	destinations := []repository.Destination{{Weight: 1}, {Weight: 3}}
+	for n, want := range []int{0, 1, 1, 1} {
+		if got := weightedChoice(destinations, func(int) int { return n }); got != want {
+			t.Errorf("Для %d ожидался вариант %d, получили %d", n, want, got)
+		}
+	}
+
+	item := &repository.InMemoryStorage{ID: "abTest", Destinations: destinations}
+	w := httptest.NewRecorder()
+	first := stickyVariant(w, httptest.NewRequest(http.MethodGet, "/abTest", nil), item)
+
+	r := httptest.NewRequest(http.MethodGet, "/abTest", nil)
+	for _, cookie := range w.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+	for i := 0; i < 10; i++ {
+		if got := stickyVariant(httptest.NewRecorder(), r, item); got != first {
+			t.Fatalf("Посетитель должен видеть вариант %d, получили %d", first, got)
+		}
+	}
+}
+
+func TestApplyWindow(t *testing.T) {
+	from := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	until := time.Now().Add(2 * time.Hour).UTC().Format(time.RFC3339)
+
+	var item repository.InMemoryStorage
+	opts := LinkOptions{ActiveFrom: from, ActiveUntil: until, PendingURL: "https://example.com/soon"}
+	if err := opts.applyWindow(&item); err != nil || !item.Scheduled(time.Now()) || item.PendingURL == "" {
+		t.Errorf("Ожидалось окно в будущем, получили %+v, %v", item, err)
+	}
+
+	if err := (LinkOptions{ActiveFrom: until, ActiveUntil: from}).applyWindow(&item); err == nil {
+		t.Error("Ожидалась ошибка для окна с концом раньше начала")
+	}
+	if err := (LinkOptions{PendingURL: "https://example.com/soon"}).applyWindow(&item); err == nil {
+		t.Error("Ожидалась ошибка для pending_url без active_from")
+	}
+}
+
+func TestWritePending(t *testing.T) {
+	conf := config.NewConfigBuilder().Pending("", "").Build()
+	now := time.Now()
+	from := now.Add(time.Minute)
+	item := &repository.InMemoryStorage{ActiveFrom: &from}
+
+	w := httptest.NewRecorder()
+	writePending(w, httptest.NewRequest(http.MethodGet, "/abc", nil), conf, item, now)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "61" {
+		t.Errorf("Ожидался 503 с Retry-After 61, получили %d, %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if !strings.Contains(w.Body.String(), config.DefaultPendingMessage) {
+		t.Errorf("Ожидалось сообщение по умолчанию, получили %q", w.Body.String())
+	}
+}
+
+func TestEmitClick(t *testing.T) {
+	if got := anonymizeIP("203.0.113.77"); got != "203.0.113.0" {
+		t.Errorf("Ожидался 203.0.113.0, получили %s", got)
+	}
+	if got := anonymizeIP("2001:db8:abcd:12::1"); got != "2001:db8:abcd::" {
+		t.Errorf("Ожидался 2001:db8:abcd::, получили %s", got)
+	}
+
+	clickChan := make(chan repository.Click, 1)
+	item := &repository.InMemoryStorage{ID: "clickID"}
+	r := httptest.NewRequest(http.MethodGet, "/clickID", nil)
+	r.Header.Set("Referer", "https://news.example.com/post")
+
+	emitClick(clickChan, r, item, -1)
+	// Второе событие не помещается в канал и должно отброситься без ожидания
+	emitClick(clickChan, r, item, -1)
+
+	click := <-clickChan
+	if click.LinkID != "clickID" || click.Referrer != "https://news.example.com/post" || click.IP != "192.0.2.0" {
+		t.Errorf("Неожиданное событие перехода: %+v", click)
+	}
+}
+
+func TestBuildStats(t *testing.T) {
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(48 * time.Hour)
+	clicks := []repository.Click{
+		{Time: from.Add(time.Hour), IP: "192.0.2.0", UserAgent: "Mozilla/5.0 (iPhone)", Referrer: "https://www.example.com/a"},
+		{Time: from.Add(2 * time.Hour), IP: "192.0.2.0", UserAgent: "Mozilla/5.0 (iPhone)"},
+		{Time: from.Add(30 * time.Hour), IP: "198.51.100.0", UserAgent: "Mozilla/5.0 (Windows NT 10.0)", Referrer: "https://example.com/b"},
+	}
+
+	stats := buildStats(clicks, from, to, 24*time.Hour)
+	if stats.Total != 3 || stats.Unique != 2 {
+		t.Errorf("Ожидалось 3 перехода и 2 посетителя, получили %d и %d", stats.Total, stats.Unique)
+	}
+	if len(stats.Series) != 2 || stats.Series[0].Clicks != 2 || stats.Series[1].Clicks != 1 {
+		t.Errorf("Неожиданный ряд по дням: %+v", stats.Series)
+	}
+	if stats.Referrers["example.com"] != 2 || stats.Referrers["direct"] != 1 {
+		t.Errorf("Неожиданные источники: %v", stats.Referrers)
+	}
+	if stats.Devices["mobile"] != 2 || stats.Devices["desktop"] != 1 {
+		t.Errorf("Неожиданные устройства: %v", stats.Devices)
+	}
+
+	if _, _, _, err := parseStatsRange(url.Values{"from": {"2020-01-01T00:00:00Z"}, "bucket": {"hour"}}, to); err == nil {
+		t.Error("Ожидалась ошибка для слишком длинного ряда")
+	}
+}
+
+func TestGetInternalStats(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/8")
+	_, proxy, _ := net.ParseCIDR("127.0.0.1/32")
+	cfg := config.NewConfigBuilder().TrustedSubnet(subnet).TrustedProxies([]*net.IPNet{proxy}).Build()
+	storage := &repository.JSON{}
+
+	cases := []struct {
+		remote, realIP string
+		want           int
+	}{
+		{"10.1.2.3:5000", "", http.StatusOK},
+		{"192.0.2.1:5000", "", http.StatusForbidden},
+		// Внешний клиент не может назваться внутренним адресом
+		{"192.0.2.1:5000", "10.9.9.9", http.StatusForbidden},
+		{"127.0.0.1:5000", "10.9.9.9", http.StatusOK},
+		{"127.0.0.1:5000", "192.0.2.1", http.StatusForbidden},
+		{"10.1.2.3:5000", "192.0.2.1", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/api/internal/stats", nil)
+		r.RemoteAddr = c.remote
+		if c.realIP != "" {
+			r.Header.Set("X-Real-IP", c.realIP)
+		}
+		w := httptest.NewRecorder()
+		GetInternalStats(w, r, cfg, storage)
+		if w.Code != c.want {
+			t.Errorf("%s, %q: ожидался код %d, получили %d", c.remote, c.realIP, c.want, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	GetInternalStats(w, httptest.NewRequest(http.MethodGet, "/api/internal/stats", nil), &config.Config{}, storage)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Без подсети доступ должен быть закрыт, получили %d", w.Code)
+	}
+}
+
+func TestParseQRParams(t *testing.T) {
+	cfg := config.NewConfigBuilder().QR(300, "Q", 2).Build()
+
+	p, err := parseQRParams(url.Values{}, cfg)
+	if err != nil || p.format != "png" || p.size != 300 || p.level != internal.QRLevelQ || p.margin != 2 {
+		t.Errorf("Ожидались значения из конфигурации, получили %+v, %v", p, err)
+	}
+
+	p, err = parseQRParams(url.Values{"format": {"SVG"}, "size": {"512"}, "level": {"h"}, "margin": {"0"}}, cfg)
+	if err != nil || p.format != "svg" || p.size != 512 || p.level != internal.QRLevelH || p.margin != 0 {
+		t.Errorf("Ожидались значения из запроса, получили %+v, %v", p, err)
+	}
+
+	for _, q := range []url.Values{{"format": {"gif"}}, {"size": {"10"}}, {"level": {"X"}}, {"margin": {"-1"}}} {
+		if _, err := parseQRParams(q, cfg); err == nil {
+			t.Errorf("Ожидалась ошибка для %v", q)
+		}
+	}
+}
+
+func TestFallbackRedirect(t *testing.T) {
+	fallbacks, err := validateFallbacks([]string{"https://mirror-1.example", "https://mirror-2.example"})
+	if err != nil {
+		t.Fatalf("Запасные адреса должны быть корректными: %v", err)
+	}
+	if _, err := validateFallbacks([]string{"https://mirror.example", "https://mirror.example"}); err == nil {
+		t.Error("Ожидалась ошибка для повторяющегося адреса")
+	}
+
+	item := &repository.InMemoryStorage{
+		ID:        "fb",
+		LongURL:   "https://primary.example",
+		Fallbacks: repository.FallbackURLs(fallbacks),
+	}
+	cfg := &config.Config{GeoHeader: "X-Country-Code"}
+
+	location := func() string {
+		w := httptest.NewRecorder()
+		followLink(w, httptest.NewRequest(http.MethodGet, "/fb", nil), cfg, &repository.JSON{}, nil, item, http.StatusFound)
+		return w.Header().Get("Location")
+	}
+
+	if got := location(); got != "https://primary.example" {
+		t.Errorf("Пока основной адрес не проверен, ожидался он, получили %s", got)
+	}
+
+	item.Health = &repository.Health{Status: http.StatusBadGateway}
+	item.Fallbacks[0].Health = &repository.Health{Status: http.StatusNotFound}
+	if got := location(); got != "https://mirror-2.example" {
+		t.Errorf("Ожидался первый рабочий запасной адрес, получили %s", got)
+	}
+
+	item.Fallbacks[1].Health = &repository.Health{}
+	if got := location(); got != "https://primary.example" {
+		t.Errorf("Без рабочих запасных адресов ожидался основной, получили %s", got)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	storage := &repository.JSON{}
+	past := time.Now().Add(-time.Hour)
+	left := int64(3)
+	for _, item := range []*repository.InMemoryStorage{
+		{ID: "pvActive", LongURL: "https://pv-active.com", UserID: "u1", ClicksLeft: &left},
+		{ID: "pvDeleted", LongURL: "https://pv-deleted.com", UserID: "u1", Flag: true},
+		{ID: "pvExpired", LongURL: "https://pv-expired.com", UserID: "u1", ExpiresAt: &past, Lapsed: true},
+		// Так истёкшие ссылки помечались раньше, до отдельной отметки
+		{ID: "pvSwept", LongURL: "https://pv-swept.com", UserID: "u1", ExpiresAt: &past, Flag: true},
+		{ID: "pvSecret", LongURL: "https://pv-secret.com", UserID: "u1", PasswordHash: "hash"},
+	} {
+		storage.SaveURL(item)
+	}
+
+	cfg := &config.Config{}
+	router := chiv5.NewRouter()
+	router.Get("/preview/{id}", func(w http.ResponseWriter, r *http.Request) {
+		GetPreview(w, r, cfg, storage)
+	})
+	router.Get("/api/preview/{id}", func(w http.ResponseWriter, r *http.Request) {
+		GetAPIPreview(w, r, cfg, storage)
+	})
+
+	for id, want := range map[string]string{
+		"pvActive":  StatusActive,
+		"pvDeleted": StatusDeleted,
+		"pvExpired": StatusExpired,
+		"pvSwept":   StatusExpired,
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/preview/"+id, nil))
+		var preview Preview
+		if err := json.NewDecoder(w.Body).Decode(&preview); err != nil || preview.Status != want {
+			t.Errorf("%s: ожидалось состояние %s, получили %+v, %v", id, want, preview, err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/preview/pvExpired", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Срок действия ссылки истёк") {
+		t.Errorf("Страница должна сообщать об истёкшем сроке, получили %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/preview/pvSecret", nil))
+	if strings.Contains(w.Body.String(), "pv-secret.com") {
+		t.Error("Адрес ссылки с паролем не должен раскрываться")
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/preview/pvMissing", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Ожидался 404 для неизвестной ссылки, получили %d", w.Code)
+	}
+
+	// Предпросмотр не списывает переходы
+	if item, err := storage.GetURL("pvActive"); err != nil || *item.ClicksLeft != left {
+		t.Errorf("Предпросмотр не должен расходовать переходы, получили %+v, %v", item, err)
+	}
+}
+
+// failingStorage отвечает ошибкой на любой запрос ссылки.
+type failingStorage struct {
+	repository.Storage
+}
+
+func (failingStorage) GetURL(string) (*repository.InMemoryStorage, error) {
+	return nil, errors.New("хранилище недоступно")
+}
+
+func TestGetURLStatsOwnerOnly(t *testing.T) {
+	storage := &repository.JSON{}
+	storage.SaveURL(&repository.InMemoryStorage{ID: "statsOwn", LongURL: "https://stats-own.com", UserID: "owner"})
+	storage.SaveClicks([]repository.Click{{LinkID: "statsOwn", Time: time.Now().UTC(), Variant: -1}})
+	storage.CountClicks([]repository.ClickCount{{LinkID: "statsOwn", Variant: -1, Clicks: 1}})
+
+	get := func(storage repository.Storage, user string) *httptest.ResponseRecorder {
+		router := chiv5.NewRouter()
+		router.Get("/api/user/urls/{id}/stats", func(w http.ResponseWriter, r *http.Request) {
+			GetURLStats(w, r, storage)
+		})
+		r := httptest.NewRequest(http.MethodGet, "/api/user/urls/statsOwn/stats", nil)
+		r = r.WithContext(context.WithValue(r.Context(), middleware.UserIDKey, user))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := get(storage, "stranger"); w.Code != http.StatusNotFound {
+		t.Errorf("Чужому пользователю ожидался 404, получили %d", w.Code)
+	}
+
+	w := get(storage, "owner")
+	var stats LinkStats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil || w.Code != http.StatusOK || stats.Total != 1 || stats.AllTime != 1 {
+		t.Errorf("Владельцу ожидалась статистика с одним переходом, получили %d %+v, %v", w.Code, stats, err)
+	}
+
+	if w := get(failingStorage{}, "owner"); w.Code != http.StatusInternalServerError {
+		t.Errorf("Ошибка хранилища должна давать 500, получили %d", w.Code)
+	}
 }
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"shortener/internal/app/handlers/service/repository"
+	"shortener/internal/config"
+	"strings"
+)
+
+// clientIP возвращает адрес клиента. X-Real-IP берётся, только если соединение
+// пришло от доверенного прокси или из доверенной подсети: иначе любой клиент
+// мог бы назваться внутренним адресом.
+func clientIP(r *http.Request, config *config.Config) net.IP {
+	remote := net.ParseIP(remoteHost(r))
+	realIP := strings.TrimSpace(r.Header.Get("X-Real-IP"))
+	if realIP == "" || remote == nil || !trustedPeer(remote, config) {
+		return remote
+	}
+	return net.ParseIP(realIP)
+}
+
+func trustedPeer(ip net.IP, config *config.Config) bool {
+	if config.TrustedSubnet != nil && config.TrustedSubnet.Contains(ip) {
+		return true
+	}
+	for _, proxy := range config.TrustedProxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetInternalStats отдаёт сводку по сервису клиентам из доверенной подсети.
+func GetInternalStats(w http.ResponseWriter, r *http.Request, config *config.Config, storage repository.Storage) {
+	ip := clientIP(r, config)
+	if config.TrustedSubnet == nil || ip == nil || !config.TrustedSubnet.Contains(ip) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	stats, err := storage.Stats()
+	if err != nil {
+		log.Println("Ошибка получения статистики сервиса", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
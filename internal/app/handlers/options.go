@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"shortener/internal"
+	"shortener/internal/app/handlers/service/repository"
+	"shortener/internal/config"
+	"strconv"
+	"time"
+)
+
+// LinkOptions — необязательные настройки ссылки, общие для всех способов сокращения.
+type LinkOptions struct {
+	ExpiresAt string `json:"expires_at,omitempty"`
+	ExpiresIn string `json:"expires_in,omitempty"`
+	MaxClicks int64  `json:"max_clicks,omitempty"`
+	Password  string `json:"password,omitempty"`
+	// RedirectCode — код перенаправления 301, 302, 307 или 308; 0 — код сервера по умолчанию.
+	RedirectCode int `json:"redirect_code,omitempty"`
+	// ForwardQuery и ForwardPath включают передачу параметров запроса и пути после идентификатора.
+	// Путь /qr зарезервирован за QR-кодом ссылки и не передаётся.
+	ForwardQuery bool `json:"forward_query,omitempty"`
+	ForwardPath  bool `json:"forward_path,omitempty"`
+	// Rules — правила выбора адреса назначения, проверяемые по порядку.
+	Rules []repository.Rule `json:"rules,omitempty"`
+	// Destinations — варианты A/B-теста с весами.
+	Destinations []repository.Destination `json:"destinations,omitempty"`
+	// ActiveFrom и ActiveUntil в RFC 3339 задают окно работы ссылки,
+	// PendingURL — куда вести посетителя до его начала.
+	ActiveFrom  string `json:"active_from,omitempty"`
+	ActiveUntil string `json:"active_until,omitempty"`
+	PendingURL  string `json:"pending_url,omitempty"`
+	// Fallbacks — запасные адреса по порядку на случай, когда основной не отвечает.
+	Fallbacks []string `json:"fallbacks,omitempty"`
+
+	// queryErr — ошибка разбора параметров POST /, которую возвращает apply.
+	queryErr error
+}
+
+// linkOptionsFromRequest читает настройки для POST /, где тело — сам адрес:
+// из параметров запроса, а пароль — из заголовка, чтобы он не попадал в журналы.
+func linkOptionsFromRequest(r *http.Request) LinkOptions {
+	q := r.URL.Query()
+	opts := LinkOptions{
+		ExpiresAt: q.Get("expires_at"),
+		ExpiresIn: q.Get("expires_in"),
+
+		ActiveFrom:  q.Get("active_from"),
+		ActiveUntil: q.Get("active_until"),
+		PendingURL:  q.Get("pending_url"),
+
+		Password: r.Header.Get("X-Link-Password"),
+	}
+
+	var queryErr, pathErr error
+	opts.ForwardQuery, queryErr = queryBool(q, "forward_query")
+	opts.ForwardPath, pathErr = queryBool(q, "forward_path")
+	opts.queryErr = errors.Join(queryErr, pathErr)
+
+	if v := q.Get("redirect_code"); v != "" {
+		// Нечисловое значение превращается в -1 и отклоняется в apply
+		code, err := strconv.Atoi(v)
+		if err != nil {
+			code = -1
+		}
+		opts.RedirectCode = code
+	}
+
+	if v := q.Get("max_clicks"); v != "" {
+		// Нечисловое значение превращается в -1 и отклоняется в apply
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			n = -1
+		}
+		opts.MaxClicks = n
+	}
+
+	return opts
+}
+
+// queryBool читает необязательный флаг из параметров запроса; пустое значение — false.
+func queryBool(q url.Values, name string) (bool, error) {
+	v := q.Get(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("некорректный %s: %q", name, v)
+	}
+	return b, nil
+}
+
+// apply проверяет настройки и переносит их в запись ссылки.
+func (o LinkOptions) apply(item *repository.InMemoryStorage, cfg *config.Config) error {
+	if o.queryErr != nil {
+		return o.queryErr
+	}
+
+	expiresAt, err := parseExpiry(o.ExpiresAt, o.ExpiresIn)
+	if err != nil {
+		return err
+	}
+	item.ExpiresAt = expiresAt
+
+	if err := o.applyWindow(item); err != nil {
+		return err
+	}
+
+	if o.MaxClicks < 0 {
+		return errors.New("max_clicks должен быть положительным числом")
+	}
+	if o.MaxClicks > 0 {
+		left := o.MaxClicks
+		item.ClicksLeft = &left
+	}
+
+	// Код фиксируется при создании, чтобы смена умолчания не меняла старые ссылки
+	switch {
+	case o.RedirectCode == 0:
+		item.RedirectCode = cfg.RedirectCode
+	case config.ValidRedirectCode(o.RedirectCode):
+		item.RedirectCode = o.RedirectCode
+	default:
+		return fmt.Errorf("некорректный redirect_code: %d", o.RedirectCode)
+	}
+
+	item.ForwardQuery = o.ForwardQuery
+	item.ForwardPath = o.ForwardPath
+
+	if err := validateRules(o.Rules); err != nil {
+		return err
+	}
+	item.Rules = o.Rules
+
+	if err := validateDestinations(o.Destinations); err != nil {
+		return err
+	}
+	item.Destinations = o.Destinations
+
+	fallbacks, err := validateFallbacks(o.Fallbacks)
+	if err != nil {
+		return err
+	}
+	item.Fallbacks = repository.FallbackURLs(fallbacks)
+
+	if o.Password != "" {
+		hash, err := internal.HashPassword(o.Password)
+		if err != nil {
+			return fmt.Errorf("не удалось сохранить пароль: %w", err)
+		}
+		item.PasswordHash = hash
+	}
+
+	return nil
+}
+
+// applyWindow проверяет окно работы ссылки и переносит его в запись.
+func (o LinkOptions) applyWindow(item *repository.InMemoryStorage) error {
+	activeFrom, err := parseMoment("active_from", o.ActiveFrom)
+	if err != nil {
+		return err
+	}
+	activeUntil, err := parseMoment("active_until", o.ActiveUntil)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case activeFrom != nil && activeUntil != nil && !activeUntil.After(*activeFrom):
+		return errors.New("active_until должен быть позже active_from")
+	case activeUntil != nil && !activeUntil.After(time.Now()):
+		return errors.New("окно работы ссылки уже закрылось")
+	case o.PendingURL != "" && activeFrom == nil:
+		return errors.New("pending_url задаётся вместе с active_from")
+	}
+
+	if o.PendingURL != "" {
+		pendingURL, err := parseURL(o.PendingURL)
+		if err != nil {
+			return fmt.Errorf("некорректный pending_url: %w", err)
+		}
+		item.PendingURL = pendingURL
+	}
+
+	item.ActiveFrom = activeFrom
+	item.ActiveUntil = activeUntil
+	return nil
+}
+
+// parseMoment читает необязательный момент времени в RFC 3339.
+func parseMoment(name, value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("некорректный %s: %w", name, err)
+	}
+	t = t.UTC()
+	return &t, nil
+}
+
+// parseExpiry читает срок действия ссылки: момент в RFC 3339 или длительность
+// вроде "72h". Пустые значения означают бессрочную ссылку.
+func parseExpiry(expiresAt, expiresIn string) (*time.Time, error) {
+	var expiry time.Time
+
+	switch {
+	case expiresAt != "" && expiresIn != "":
+		return nil, errors.New("укажите только expires_at или expires_in")
+	case expiresAt != "":
+		t, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("некорректный expires_at: %w", err)
+		}
+		expiry = t.UTC()
+	case expiresIn != "":
+		d, err := time.ParseDuration(expiresIn)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("некорректный expires_in: %q", expiresIn)
+		}
+		expiry = time.Now().UTC().Add(d)
+	default:
+		return nil, nil
+	}
+
+	if !expiry.After(time.Now()) {
+		return nil, errors.New("срок действия уже истёк")
+	}
+	return &expiry, nil
+}
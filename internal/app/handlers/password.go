@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"shortener/internal"
+	"shortener/internal/app/handlers/service/repository"
+	"shortener/internal/config"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxPasswordAttempts неверных паролей за passwordWindow блокируют перебор для клиента.
+	maxPasswordAttempts = 5
+	passwordWindow      = 15 * time.Minute
+	maxPasswordFormSize = 4 << 10
+)
+
+var passwordForm = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Ссылка защищена паролем</title></head>
+<body>
+<form method="post">
+<p>Для перехода по ссылке введите пароль.</p>
+{{if .}}<p style="color: #b00">{{.}}</p>{{end}}
+<input type="password" name="password" autofocus required>
+<button type="submit">Перейти</button>
+</form>
+</body>
+</html>
+`))
+
+func renderPasswordForm(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := passwordForm.Execute(w, message); err != nil {
+		log.Println("Ошибка вывода формы пароля", err)
+	}
+}
+
+// attemptLimiter считает неудачные попытки по ключу в скользящем окне.
+type attemptLimiter struct {
+	mu       sync.Mutex
+	limit    int
+	window   time.Duration
+	attempts map[string]*attemptWindow
+}
+
+type attemptWindow struct {
+	count int
+	start time.Time
+}
+
+func newAttemptLimiter(limit int, window time.Duration) *attemptLimiter {
+	return &attemptLimiter{limit: limit, window: window, attempts: make(map[string]*attemptWindow)}
+}
+
+// Attempt занимает попытку для ключа до проверки пароля и сообщает, сколько
+// ждать, если попытки в окне закончились. Попытка считается сразу, поэтому
+// параллельные запросы не проходят мимо лимита. Успешный вход снимает счёт через Reset.
+func (l *attemptLimiter) Attempt(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	a, ok := l.attempts[key]
+	if !ok || now.Sub(a.start) >= l.window {
+		a = &attemptWindow{start: now}
+		l.attempts[key] = a
+	}
+	if a.count >= l.limit {
+		return false, a.start.Add(l.window).Sub(now)
+	}
+	a.count++
+
+	// Старые окна чистятся попутно, чтобы карта не росла бесконечно
+	if len(l.attempts) > 1000 {
+		for k, v := range l.attempts {
+			if now.Sub(v.start) >= l.window {
+				delete(l.attempts, k)
+			}
+		}
+	}
+	return true, 0
+}
+
+func (l *attemptLimiter) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.attempts, key)
+}
+
+var passwordLimiter = newAttemptLimiter(maxPasswordAttempts, passwordWindow)
+
+// checkPassword подменяется в тестах, чтобы считать дорогие проверки.
+var checkPassword = internal.CheckPassword
+
+// remoteHost возвращает адрес клиента из соединения.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// PostPassword проверяет пароль из формы и перенаправляет на адрес защищённой ссылки.
+func PostPassword(w http.ResponseWriter, r *http.Request, config *config.Config, storage repository.Storage, clickChan chan<- repository.Click) {
+	item, ok := activeLink(w, r, config, storage)
+	if !ok {
+		return
+	}
+	if item.PasswordHash == "" {
+		followLink(w, r, config, storage, clickChan, item, http.StatusSeeOther)
+		return
+	}
+
+	key := item.ID + "|" + remoteHost(r)
+	if allowed, wait := passwordLimiter.Attempt(key, time.Now()); !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		renderPasswordForm(w, http.StatusTooManyRequests, "Слишком много попыток, попробуйте позже")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxPasswordFormSize)
+	if err := r.ParseForm(); err != nil {
+		renderPasswordForm(w, http.StatusBadRequest, "Некорректная форма")
+		return
+	}
+
+	ok, err := checkPassword(item.PasswordHash, r.PostFormValue("password"))
+	if err != nil {
+		log.Printf("Ошибка проверки пароля ссылки %s: %s", item.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		renderPasswordForm(w, http.StatusUnauthorized, "Неверный пароль")
+		return
+	}
+
+	passwordLimiter.Reset(key)
+	// После POST браузер должен прийти на адрес ссылки GET-запросом
+	followLink(w, r, config, storage, clickChan, item, http.StatusSeeOther)
+}
@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"shortener/internal/app/handlers/service/repository"
+	"shortener/internal/config"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Состояния ссылки на странице предпросмотра.
+const (
+	StatusActive  = "active"
+	StatusDeleted = "deleted"
+	StatusExpired = "expired"
+	StatusPending = "pending"
+)
+
+// Preview описывает ссылку, не переходя по ней.
+type Preview struct {
+	ShortURL  string     `json:"short_url"`
+	LongURL   string     `json:"original_url,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// ActiveFrom и ActiveUntil — окно работы ссылки.
+	ActiveFrom  *time.Time `json:"active_from,omitempty"`
+	ActiveUntil *time.Time `json:"active_until,omitempty"`
+	Status      string     `json:"status"`
+	Protected   bool       `json:"protected,omitempty"`
+}
+
+var previewPage = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="robots" content="noindex"><title>Куда ведёт ссылка</title></head>
+<body>
+<p>Короткая ссылка: {{.ShortURL}}</p>
+{{if .Protected}}<p>Ссылка защищена паролем, адрес назначения скрыт.</p>
+{{else}}<p>Ведёт на: <a href="{{.LongURL}}" rel="nofollow noopener">{{.LongURL}}</a></p>
+{{end}}{{if .CreatedAt}}<p>Создана: {{.CreatedAt.Format "02.01.2006 15:04 MST"}}</p>
+{{end}}{{if eq .Status "active"}}<p>Ссылка действует.</p>
+{{else if eq .Status "expired"}}<p>Срок действия ссылки истёк.</p>
+{{else if eq .Status "pending"}}<p>Ссылка ещё не активна{{if .ActiveFrom}}, начнёт работать {{.ActiveFrom.Format "02.01.2006 15:04 MST"}}{{end}}.</p>
+{{else}}<p>Ссылка удалена.</p>
+{{end}}</body>
+</html>
+`))
+
+// findPreview собирает описание ссылки из пути запроса. Переход не списывается.
+func findPreview(r *http.Request, storage repository.Storage) (*Preview, bool) {
+	item, err := storage.GetURL(chi.URLParam(r, "id"))
+	if err != nil {
+		return nil, false
+	}
+
+	preview := Preview{
+		ShortURL:  item.ShortURL,
+		ExpiresAt: item.ExpiresAt,
+
+		ActiveFrom:  item.ActiveFrom,
+		ActiveUntil: item.ActiveUntil,
+
+		Status:    StatusActive,
+		Protected: item.PasswordHash != "",
+	}
+	// Адрес ссылки с паролем не раскрывается, иначе пароль теряет смысл
+	if !preview.Protected {
+		preview.LongURL = item.LongURL
+	}
+	if !item.CreatedAt.IsZero() {
+		preview.CreatedAt = &item.CreatedAt
+	}
+
+	now := time.Now()
+	// Срок проверяется раньше пометки удаления: ссылки, помеченные до появления
+	// отдельной отметки об истечении, тоже показываются истёкшими
+	switch {
+	case item.Lapsed || item.Expired(now) || item.Ended(now) || (item.ClicksLeft != nil && *item.ClicksLeft <= 0):
+		preview.Status = StatusExpired
+	case item.Flag:
+		preview.Status = StatusDeleted
+	case item.Scheduled(now):
+		preview.Status = StatusPending
+	}
+
+	return &preview, true
+}
+
+// GetPreview показывает страницу с адресом назначения вместо перехода.
+func GetPreview(w http.ResponseWriter, r *http.Request, config *config.Config, storage repository.Storage) {
+	preview, ok := findPreview(r, storage)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := previewPage.Execute(w, preview); err != nil {
+		log.Println("Ошибка вывода страницы предпросмотра", err)
+	}
+}
+
+// GetAPIPreview возвращает то же описание ссылки в JSON.
+func GetAPIPreview(w http.ResponseWriter, r *http.Request, config *config.Config, storage repository.Storage) {
+	preview, ok := findPreview(r, storage)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preview)
+}
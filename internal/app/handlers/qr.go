@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"image/png"
+	"log"
+	"net/http"
+	"net/url"
+	"shortener/internal"
+	"shortener/internal/app/handlers/service/repository"
+	"shortener/internal/config"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// qrPath — путь QR-кода после идентификатора ссылки. Он зарезервирован:
+// ссылки с ForwardPath не передают его адресу назначения.
+const qrPath = "qr"
+
+// qrURL возвращает адрес QR-кода короткой ссылки.
+func qrURL(shortURL string) string {
+	return strings.TrimSuffix(shortURL, "/") + "/" + qrPath
+}
+
+// qrParams — параметры отрисовки QR-кода.
+type qrParams struct {
+	format string
+	size   int
+	level  internal.QRLevel
+	margin int
+}
+
+// parseQRParams читает format, size, level и margin запроса поверх значений из конфигурации.
+func parseQRParams(q url.Values, config *config.Config) (qrParams, error) {
+	p := qrParams{format: "png", size: config.QRSize, margin: config.QRMargin}
+	if p.size == 0 {
+		p.size = 256
+	}
+
+	levelName := config.QRLevel
+	if v := q.Get("level"); v != "" {
+		levelName = v
+	}
+	if levelName == "" {
+		levelName = "M"
+	}
+	level, err := internal.ParseQRLevel(levelName)
+	if err != nil {
+		return p, err
+	}
+	p.level = level
+
+	if v := q.Get("format"); v != "" {
+		p.format = strings.ToLower(v)
+	}
+	if p.format != "png" && p.format != "svg" {
+		return p, fmt.Errorf("неизвестный формат QR-кода: %q", p.format)
+	}
+
+	if v := q.Get("size"); v != "" {
+		if p.size, err = strconv.Atoi(v); err != nil {
+			return p, fmt.Errorf("некорректный size: %q", v)
+		}
+	}
+	if p.size < internal.MinQRSize || p.size > internal.MaxQRSize {
+		return p, fmt.Errorf("size должен быть от %d до %d", internal.MinQRSize, internal.MaxQRSize)
+	}
+
+	if v := q.Get("margin"); v != "" {
+		if p.margin, err = strconv.Atoi(v); err != nil {
+			return p, fmt.Errorf("некорректный margin: %q", v)
+		}
+	}
+	if p.margin < 0 || p.margin > internal.MaxQRMargin {
+		return p, fmt.Errorf("margin должен быть от 0 до %d", internal.MaxQRMargin)
+	}
+
+	return p, nil
+}
+
+// GetQR отдаёт QR-код короткой ссылки в PNG или SVG. Переход при этом не засчитывается.
+func GetQR(w http.ResponseWriter, r *http.Request, config *config.Config, storage repository.Storage) {
+	params, err := parseQRParams(r.URL.Query(), config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	item, err := storage.GetURL(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if item.Flag {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+
+	code, err := internal.EncodeQR([]byte(item.ShortURL), params.level)
+	if errors.Is(err, internal.ErrQRTooLong) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Println("Ошибка построения QR-кода", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	if params.format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(code.SVG(params.size, params.margin))
+		return
+	}
+
+	// Пиксельный код масштабируется целым числом точек на модуль, чтобы края оставались чёткими
+	scale := params.size / (code.Size + 2*params.margin)
+	if scale < 1 {
+		scale = 1
+	}
+	w.Header().Set("Content-Type", "image/png")
+	if err := png.Encode(w, code.Image(scale, params.margin)); err != nil {
+		log.Println("Ошибка вывода QR-кода", err)
+	}
+}
@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"shortener/internal/app/handlers/service/repository"
+	"shortener/internal/app/middleware"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// maxRules ограничивает число правил у одной ссылки: они проверяются при каждом переходе.
+const maxRules = 20
+
+// Платформы, которые распознаются по User-Agent.
+var platforms = map[string]bool{
+	"ios": true, "android": true, "windows": true, "macos": true, "linux": true,
+	"mobile": true, "desktop": true,
+}
+
+var (
+	languageTag = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+	countryCode = regexp.MustCompile(`^[A-Za-z]{2}$`)
+)
+
+// validateRules проверяет правила и приводит условия к нижнему регистру.
+// Проверку адреса записывает только HealthHandler, поэтому присланная отбрасывается.
+func validateRules(rules []repository.Rule) error {
+	if len(rules) > maxRules {
+		return fmt.Errorf("не больше %d правил", maxRules)
+	}
+
+	for i := range rules {
+		rule := &rules[i]
+		rule.Platform = strings.ToLower(strings.TrimSpace(rule.Platform))
+		rule.Language = strings.ToLower(strings.TrimSpace(rule.Language))
+		rule.Country = strings.ToLower(strings.TrimSpace(rule.Country))
+
+		switch {
+		case rule.Platform == "" && rule.Language == "" && rule.Country == "":
+			return fmt.Errorf("правило %d: нужно хотя бы одно условие", i+1)
+		case rule.Platform != "" && !platforms[rule.Platform]:
+			return fmt.Errorf("правило %d: неизвестная платформа %q", i+1, rule.Platform)
+		case rule.Language != "" && !languageTag.MatchString(rule.Language):
+			return fmt.Errorf("правило %d: некорректный язык %q", i+1, rule.Language)
+		case rule.Country != "" && !countryCode.MatchString(rule.Country):
+			return fmt.Errorf("правило %d: некорректный код страны %q", i+1, rule.Country)
+		}
+
+		longURL, err := parseURL(rule.URL)
+		if err != nil {
+			return fmt.Errorf("правило %d: некорректный адрес: %w", i+1, err)
+		}
+		rule.URL = longURL
+		rule.Health = nil
+	}
+
+	return nil
+}
+
+// ruleVary перечисляет заголовки, по которым matchRules выбирает правило.
+func ruleVary(geoHeader string) string {
+	vary := "User-Agent, Accept-Language"
+	if geoHeader != "" {
+		vary += ", " + geoHeader
+	}
+	return vary
+}
+
+// matchRules возвращает адрес первого подходящего правила.
+func matchRules(r *http.Request, rules []repository.Rule, geoHeader string) (string, bool) {
+	if len(rules) == 0 {
+		return "", false
+	}
+
+	ua := strings.ToLower(r.UserAgent())
+	language := preferredLanguage(r.Header.Get("Accept-Language"))
+	country := ""
+	if geoHeader != "" {
+		country = strings.ToLower(strings.TrimSpace(r.Header.Get(geoHeader)))
+	}
+
+	for _, rule := range rules {
+		if rule.Platform != "" && !matchPlatform(rule.Platform, ua) {
+			continue
+		}
+		if rule.Language != "" && language != rule.Language && !strings.HasPrefix(language, rule.Language+"-") {
+			continue
+		}
+		if rule.Country != "" && country != rule.Country {
+			continue
+		}
+		return rule.URL, true
+	}
+
+	return "", false
+}
+
+// matchPlatform сверяет платформу с User-Agent в нижнем регистре.
+func matchPlatform(platform, ua string) bool {
+	ios := strings.Contains(ua, "iphone") || strings.Contains(ua, "ipad") || strings.Contains(ua, "ipod")
+	android := strings.Contains(ua, "android")
+
+	switch platform {
+	case "ios":
+		return ios
+	case "android":
+		return android
+	case "windows":
+		return strings.Contains(ua, "windows")
+	case "macos":
+		return strings.Contains(ua, "macintosh") && !ios
+	case "linux":
+		return strings.Contains(ua, "linux") && !android
+	case "mobile":
+		return ios || android || strings.Contains(ua, "mobile")
+	case "desktop":
+		return ua != "" && !ios && !android && !strings.Contains(ua, "mobile")
+	}
+	return false
+}
+
+// preferredLanguage возвращает язык с наибольшим весом из Accept-Language.
+func preferredLanguage(header string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		// При равном весе выигрывает язык, указанный раньше
+		if q > bestQ {
+			best, bestQ = tag, q
+		}
+	}
+	return best
+}
+
+// PutURLRules заменяет правила перенаправления ссылки пользователя.
+func PutURLRules(w http.ResponseWriter, r *http.Request, storage repository.Storage) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		fmt.Println("userID not found in context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	version, err := parseIfMatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var rules []repository.Rule
+	if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateRules(rules); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	version, err = storage.SetRules(chi.URLParam(r, "id"), userID, version, rules)
+	if writeLinkError(w, err) {
+		return
+	}
+
+	if rules == nil {
+		rules = []repository.Rule{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", formatETag(version))
+	json.NewEncoder(w).Encode(rules)
+}
@@ -0,0 +1,251 @@
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// clickBatch — сколько событий переходов записывается в хранилище за раз.
+	clickBatch = 100
+	// memoryClicks — сколько последних событий хранит JSON: счётчики ссылок от этого не зависят.
+	memoryClicks = 100000
+	// maxClickLine ограничивает строку файла переходов: в ней длинный User-Agent.
+	maxClickLine = 1 << 20
+)
+
+// Click — событие перехода по короткой ссылке.
+type Click struct {
+	LinkID    string    `json:"link_id"`
+	Time      time.Time `json:"time"`
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	// IP обезличен: у IPv4 обнулён последний октет, у IPv6 — всё после /48.
+	IP string `json:"ip,omitempty"`
+	// Variant — индекс варианта A/B-теста или -1, Destination — адрес этого варианта.
+	// По адресу учёт отличает вариант от замены, сделанной до записи пачки.
+	Variant     int    `json:"variant"`
+	Destination string `json:"destination,omitempty"`
+}
+
+// ClickCount — сколько переходов получила ссылка за пачку; Variant — индекс
+// варианта A/B-теста или -1, URL — адрес варианта в момент перехода.
+type ClickCount struct {
+	LinkID  string
+	Variant int
+	URL     string
+	Clicks  int64
+}
+
+// clickCounts сводит переходы пачки по ссылкам и вариантам в порядке первого появления.
+func clickCounts(clicks []Click) []ClickCount {
+	var counts []ClickCount
+	index := make(map[ClickCount]int)
+	for _, c := range clicks {
+		key := ClickCount{LinkID: c.LinkID, Variant: c.Variant, URL: c.Destination}
+		if key.Variant < 0 {
+			key.Variant, key.URL = -1, ""
+		}
+		i, ok := index[key]
+		if !ok {
+			i = len(counts)
+			index[key] = i
+			counts = append(counts, key)
+		}
+		counts[i].Clicks++
+	}
+	return counts
+}
+
+// ClickHandler собирает события переходов в пачки и записывает их в хранилище:
+// когда набралась пачка или прошёл interval. После закрытия канала дописывает остаток.
+// Счётчики переходов ссылок и вариантов A/B-теста обновляются здесь же, одной
+// записью на пачку.
+func ClickHandler(storage Storage, clickChan <-chan Click, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	batch := make([]Click, 0, clickBatch)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := storage.SaveClicks(batch); err != nil {
+			log.Printf("Ошибка записи %d переходов: %v", len(batch), err)
+		}
+		if err := storage.CountClicks(clickCounts(batch)); err != nil {
+			log.Printf("Ошибка учёта переходов ссылок: %v", err)
+		}
+		batch = make([]Click, 0, clickBatch)
+	}
+
+	for {
+		select {
+		case click, ok := <-clickChan:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, click)
+			if len(batch) >= clickBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (in *JSON) SaveClicks(clicks []Click) error {
+	in.Lock()
+	defer in.Unlock()
+
+	InMemoryCollection.Clicks = append(InMemoryCollection.Clicks, clicks...)
+	if extra := len(InMemoryCollection.Clicks) - memoryClicks; extra > 0 {
+		InMemoryCollection.Clicks = append([]Click(nil), InMemoryCollection.Clicks[extra:]...)
+	}
+	return nil
+}
+
+// clicksFile — файл с переходами рядом с файлом ссылок, по событию в строке.
+func (fs *FileStorage) clicksFile() string {
+	return fs.filename + ".clicks"
+}
+
+// SaveClicks дописывает переходы в отдельный файл, чтобы не переписывать файл ссылок.
+func (fs *FileStorage) SaveClicks(clicks []Click) error {
+	fs.clicks.Lock()
+	defer fs.clicks.Unlock()
+
+	file, err := os.OpenFile(fs.clicksFile(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, click := range clicks {
+		if err := encoder.Encode(click); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+// SaveClicks загружает пачку переходов одной командой COPY.
+func (ds *DatabaseStorage) SaveClicks(clicks []Click) error {
+	tx, err := ds.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(pq.CopyIn("clicks", "url_id", "clicked_at", "referrer", "user_agent", "ip", "variant"))
+	if err != nil {
+		return err
+	}
+
+	for _, c := range clicks {
+		if _, err := stmt.Exec(c.LinkID, c.Time, c.Referrer, c.UserAgent, c.IP, c.Variant); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// clicksInRange отбирает переходы ссылки за [from, to).
+func clicksInRange(clicks []Click, id string, from, to time.Time) []Click {
+	var result []Click
+	for _, c := range clicks {
+		if c.LinkID == id && !c.Time.Before(from) && c.Time.Before(to) {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+func (in *JSON) GetClicks(id string, from, to time.Time) ([]Click, error) {
+	in.Lock()
+	defer in.Unlock()
+
+	return clicksInRange(InMemoryCollection.Clicks, id, from, to), nil
+}
+
+func (fs *FileStorage) GetClicks(id string, from, to time.Time) ([]Click, error) {
+	fs.clicks.Lock()
+	defer fs.clicks.Unlock()
+
+	file, err := os.Open(fs.clicksFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Разбираются только строки нужной ссылки: Encode пишет поле без пробелов
+	key, err := json.Marshal(id)
+	if err != nil {
+		return nil, err
+	}
+	key = append([]byte(`"link_id":`), key...)
+
+	var result []Click
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), maxClickLine)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if !bytes.Contains(line, key) {
+			continue
+		}
+		var c Click
+		if err := json.Unmarshal(line, &c); err != nil {
+			return nil, err
+		}
+		if c.LinkID == id && !c.Time.Before(from) && c.Time.Before(to) {
+			result = append(result, c)
+		}
+	}
+	return result, scanner.Err()
+}
+
+func (ds *DatabaseStorage) GetClicks(id string, from, to time.Time) ([]Click, error) {
+	query := `
+		SELECT url_id, clicked_at, referrer, user_agent, ip, variant FROM clicks
+		WHERE url_id = $1 AND clicked_at >= $2 AND clicked_at < $3
+		ORDER BY clicked_at
+	`
+
+	rows, err := ds.db.Query(query, id, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Click
+	for rows.Next() {
+		var c Click
+		if err := rows.Scan(&c.LinkID, &c.Time, &c.Referrer, &c.UserAgent, &c.IP, &c.Variant); err != nil {
+			return nil, err
+		}
+		result = append(result, c)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,90 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+)
+
+// Fallback — запасной адрес, на который ведёт ссылка, пока основной не отвечает.
+type Fallback struct {
+	URL string `json:"url"`
+	// Health — последняя проверка запасного адреса; nil — ещё не проверялся.
+	Health *Health `json:"health,omitempty"`
+}
+
+// FallbackURLs переносит адреса в список запасных без проверок.
+func FallbackURLs(urls []string) []Fallback {
+	if len(urls) == 0 {
+		return nil
+	}
+	fallbacks := make([]Fallback, len(urls))
+	for i, u := range urls {
+		fallbacks[i] = Fallback{URL: u}
+	}
+	return fallbacks
+}
+
+// setFallbacks заменяет запасные адреса ссылки пользователя и возвращает её новую версию.
+func setFallbacks(records []InMemoryStorage, id, user string, version int64, fallbacks []Fallback) (int64, error) {
+	idx, err := ownedRecord(records, id, user, version)
+	if err != nil {
+		return 0, err
+	}
+
+	records[idx].Fallbacks = fallbacks
+	records[idx].Version++
+	return records[idx].Version, nil
+}
+
+func (in *JSON) SetFallbacks(id, user string, version int64, fallbacks []Fallback) (int64, error) {
+	in.Lock()
+	defer in.Unlock()
+
+	return setFallbacks(InMemoryCollection.ObjectURL, id, user, version, fallbacks)
+}
+
+func (fs *FileStorage) SetFallbacks(id, user string, version int64, fallbacks []Fallback) (int64, error) {
+	fs.addData.Lock()
+	defer fs.addData.Unlock()
+
+	obj, err := fs.readObjects()
+	if err != nil {
+		return 0, err
+	}
+
+	newVersion, err := setFallbacks(obj.ObjectURL, id, user, version, fallbacks)
+	if err != nil {
+		return 0, err
+	}
+
+	return newVersion, fs.writeObjects(obj)
+}
+
+// marshalFallbacks записывает запасные адреса в JSON для столбца fallbacks; пустой список — "[]".
+func marshalFallbacks(fallbacks []Fallback) ([]byte, error) {
+	if fallbacks == nil {
+		fallbacks = []Fallback{}
+	}
+	return json.Marshal(fallbacks)
+}
+
+func (ds *DatabaseStorage) SetFallbacks(id, user string, version int64, fallbacks []Fallback) (int64, error) {
+	data, err := marshalFallbacks(fallbacks)
+	if err != nil {
+		return 0, err
+	}
+
+	updateQuery := `
+		UPDATE urls SET fallbacks = $1, version = version + 1
+		WHERE lower(id) = lower($2) AND user_id = $3 AND NOT flag AND ($4::bigint = 0 OR version = $4)
+		RETURNING version
+	`
+
+	var newVersion int64
+	err = ds.db.QueryRow(updateQuery, data, id, user, version).Scan(&newVersion)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ds.missing(id, user, version)
+	}
+	return newVersion, err
+}
@@ -0,0 +1,372 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/url"
+	"shortener/internal"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Health — результат последней проверки адреса назначения ссылки.
+type Health struct {
+	// Status — код ответа; 0, если ответа не было.
+	Status    int       `json:"status,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Healthy   bool      `json:"healthy"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Broken сообщает, что последняя проверка адреса не прошла.
+func (h *Health) Broken() bool {
+	return h != nil && !h.Healthy
+}
+
+// BrokenTarget сообщает, что последняя проверка основного адреса, адреса правила
+// или варианта A/B-теста не прошла.
+func (r Rez) BrokenTarget() bool {
+	if r.Health.Broken() {
+		return true
+	}
+	for _, rule := range r.Rules {
+		if rule.Health.Broken() {
+			return true
+		}
+	}
+	for _, d := range r.Destinations {
+		if d.Health.Broken() {
+			return true
+		}
+	}
+	return false
+}
+
+// HealthResult — проверка адреса Target у ссылки ID.
+type HealthResult struct {
+	ID     string
+	Target string
+	Health Health
+}
+
+// HealthOptions задаёт, как проверяются адреса назначения.
+type HealthOptions struct {
+	// Workers — сколько сайтов проверяется одновременно.
+	Workers int
+	// HostDelay — пауза между запросами к одному сайту.
+	HostDelay time.Duration
+	// Timeout ограничивает одну проверку.
+	Timeout time.Duration
+	// OnlyFallbacks ограничивает проверку ссылками с запасными адресами:
+	// им нужна свежая проверка, чтобы вовремя переключить переход.
+	OnlyFallbacks bool
+}
+
+// HealthHandler проверяет адреса назначения действующих ссылок и записывает
+// результат в хранилище: все ссылки — раз в interval, ссылки с запасными адресами —
+// раз в probeInterval. Проверки идут в одном цикле друг за другом, поэтому
+// ограничения на сайт из opts действуют для обеих. Нулевой интервал отключает
+// свою проверку.
+func HealthHandler(storage Storage, checker internal.LinkChecker, interval, probeInterval time.Duration, opts HealthOptions) {
+	tick := interval
+	if probeInterval > 0 && (tick <= 0 || probeInterval < tick) {
+		tick = probeInterval
+	}
+	if tick <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	// Тикер пропускает срабатывания, пока идёт проверка, поэтому они не накладываются
+	lastFull := time.Now()
+	for now := range ticker.C {
+		round := opts
+		if fullHealthDue(now, lastFull, interval, tick) {
+			lastFull = now
+			round.OnlyFallbacks = false
+		} else if probeInterval > 0 {
+			round.OnlyFallbacks = true
+		} else {
+			continue
+		}
+
+		if err := CheckHealth(storage, checker, now, round); err != nil {
+			log.Printf("Ошибка проверки адресов назначения: %v", err)
+		}
+	}
+}
+
+// fullHealthDue сообщает, что пора проверить все ссылки. Срабатывание тикера
+// может немного опередить interval, поэтому допускается половина tick.
+func fullHealthDue(now, lastFull time.Time, interval, tick time.Duration) bool {
+	return interval > 0 && now.Sub(lastFull) >= interval-tick/2
+}
+
+// CheckHealth проверяет все адреса назначения действующих ссылок один раз. Запросы к одному
+// сайту идут друг за другом с паузой opts.HostDelay, разные сайты проверяются
+// параллельно, но не больше opts.Workers одновременно. Результаты записываются
+// в хранилище одним вызовом в конце проверки.
+func CheckHealth(storage Storage, checker internal.LinkChecker, now time.Time, opts HealthOptions) error {
+	items, err := storage.ActiveURLs(now)
+	if err != nil {
+		return err
+	}
+
+	// Одинаковые адреса разных ссылок проверяются один раз
+	hosts := make(map[string][]string)
+	links := make(map[string][]string)
+	for _, item := range items {
+		if opts.OnlyFallbacks && len(item.Fallbacks) == 0 {
+			continue
+		}
+
+		for _, target := range healthTargets(item, opts.OnlyFallbacks) {
+			u, err := url.Parse(target)
+			if err != nil || u.Host == "" {
+				continue
+			}
+			host := strings.ToLower(u.Hostname())
+			ids := links[target]
+			if ids == nil {
+				hosts[host] = append(hosts[host], target)
+			}
+			// Один адрес может встречаться в ссылке несколько раз
+			if len(ids) == 0 || ids[len(ids)-1] != item.ID {
+				links[target] = append(ids, item.ID)
+			}
+		}
+	}
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var results []HealthResult
+
+	for _, targets := range hosts {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(targets []string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			for i, target := range targets {
+				if i > 0 {
+					time.Sleep(opts.HostDelay)
+				}
+				health := checkLink(checker, target, opts.Timeout)
+				mu.Lock()
+				for _, id := range links[target] {
+					results = append(results, HealthResult{ID: id, Target: target, Health: health})
+				}
+				mu.Unlock()
+			}
+		}(targets)
+	}
+
+	wg.Wait()
+	if len(results) == 0 {
+		return nil
+	}
+	return storage.SetHealth(results)
+}
+
+// healthTargets перечисляет адреса ссылки для проверки: основной, запасные и,
+// кроме пробной проверки, адреса правил и вариантов A/B-теста.
+func healthTargets(item InMemoryStorage, onlyFallbacks bool) []string {
+	targets := []string{item.LongURL}
+	for _, f := range item.Fallbacks {
+		targets = append(targets, f.URL)
+	}
+	if onlyFallbacks {
+		return targets
+	}
+	for _, rule := range item.Rules {
+		targets = append(targets, rule.URL)
+	}
+	for _, d := range item.Destinations {
+		targets = append(targets, d.URL)
+	}
+	return targets
+}
+
+func checkLink(checker internal.LinkChecker, target string, timeout time.Duration) Health {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	status, err := checker.Check(ctx, target)
+	health := Health{Status: status, Healthy: err == nil && internal.HealthyStatus(status), CheckedAt: time.Now().UTC()}
+	if err != nil {
+		health.Error = err.Error()
+	}
+	return health
+}
+
+// activeRecords копирует ссылки, которые не удалены и не истекли к моменту now.
+func activeRecords(records []InMemoryStorage, now time.Time) []InMemoryStorage {
+	var result []InMemoryStorage
+	for _, v := range records {
+		if !v.Flag && !v.Expired(now) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// setHealth записывает проверку во все адреса ссылки, равные target.
+func setHealth(records []InMemoryStorage, id, target string, health Health) bool {
+	for i := range records {
+		if !strings.EqualFold(records[i].ID, id) {
+			continue
+		}
+
+		rec := &records[i]
+		changed := false
+		if rec.LongURL == target {
+			rec.Health = &health
+			changed = true
+		}
+		for j := range rec.Fallbacks {
+			if rec.Fallbacks[j].URL == target {
+				h := health
+				rec.Fallbacks[j].Health = &h
+				changed = true
+			}
+		}
+		for j := range rec.Rules {
+			if rec.Rules[j].URL == target {
+				h := health
+				rec.Rules[j].Health = &h
+				changed = true
+			}
+		}
+		for j := range rec.Destinations {
+			if rec.Destinations[j].URL == target {
+				h := health
+				rec.Destinations[j].Health = &h
+				changed = true
+			}
+		}
+		return changed
+	}
+	return false
+}
+
+// setHealthResults записывает проверки раунда и сообщает, изменилось ли что-нибудь.
+func setHealthResults(records []InMemoryStorage, results []HealthResult) bool {
+	changed := false
+	for _, r := range results {
+		if setHealth(records, r.ID, r.Target, r.Health) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (in *JSON) ActiveURLs(now time.Time) ([]InMemoryStorage, error) {
+	in.Lock()
+	defer in.Unlock()
+
+	return activeRecords(InMemoryCollection.ObjectURL, now), nil
+}
+
+func (in *JSON) SetHealth(results []HealthResult) error {
+	in.Lock()
+	defer in.Unlock()
+
+	setHealthResults(InMemoryCollection.ObjectURL, results)
+	return nil
+}
+
+func (fs *FileStorage) ActiveURLs(now time.Time) ([]InMemoryStorage, error) {
+	fs.addData.Lock()
+	defer fs.addData.Unlock()
+
+	obj, err := fs.readObjects()
+	if err != nil {
+		return nil, err
+	}
+
+	return activeRecords(obj.ObjectURL, now), nil
+}
+
+// SetHealth переписывает файл ссылок один раз на весь раунд проверки.
+func (fs *FileStorage) SetHealth(results []HealthResult) error {
+	fs.addData.Lock()
+	defer fs.addData.Unlock()
+
+	obj, err := fs.readObjects()
+	if err != nil {
+		return err
+	}
+
+	if !setHealthResults(obj.ObjectURL, results) {
+		return nil
+	}
+
+	return fs.writeObjects(obj)
+}
+
+func (ds *DatabaseStorage) ActiveURLs(now time.Time) ([]InMemoryStorage, error) {
+	rows, err := ds.db.Query(`SELECT `+urlColumns+` FROM urls WHERE NOT flag AND (expires_at IS NULL OR expires_at > $1)`, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []InMemoryStorage
+	for rows.Next() {
+		item, err := scanURL(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *item)
+	}
+	return result, rows.Err()
+}
+
+// SetHealth записывает все проверки раунда в одной транзакции.
+func (ds *DatabaseStorage) SetHealth(results []HealthResult) error {
+	primaryQuery := `UPDATE urls SET health = $1 WHERE lower(id) = lower($2) AND long_url = $3`
+
+	// Проверка дописывается к каждому запасному адресу, правилу и варианту, равному target, с сохранением порядка
+	var listQueries []string
+	for _, column := range []string{"fallbacks", "rules", "destinations"} {
+		listQueries = append(listQueries, `
+			UPDATE urls SET `+column+` = (
+				SELECT jsonb_agg(CASE WHEN f->>'url' = $3 THEN jsonb_set(f, '{health}', $1::jsonb) ELSE f END ORDER BY n)
+				FROM jsonb_array_elements(`+column+`) WITH ORDINALITY AS t(f, n)
+			)
+			WHERE lower(id) = lower($2) AND `+column+` @> jsonb_build_array(jsonb_build_object('url', $3::text))
+		`)
+	}
+
+	tx, err := ds.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, r := range results {
+		data, err := json.Marshal(r.Health)
+		if err != nil {
+			return err
+		}
+		for _, query := range append([]string{primaryQuery}, listQueries...) {
+			if _, err := tx.Exec(query, data, r.ID, r.Target); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
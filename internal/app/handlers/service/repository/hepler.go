@@ -1,27 +1,320 @@
 package repository
 
-import "sync"
+import (
+	"strings"
+	"sync"
+	"time"
+)
 
 type Rez struct {
-	ShortURL string `json:"short_url"`
-	LongURL  string `json:"original_url"`
+	ShortURL  string     `json:"short_url"`
+	LongURL   string     `json:"original_url"`
+	Version   int64      `json:"version,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	Clicks     int64  `json:"clicks,omitempty"`
+	ClicksLeft *int64 `json:"clicks_left,omitempty"`
+	Protected  bool   `json:"protected,omitempty"`
+
+	RedirectCode int  `json:"redirect_code,omitempty"`
+	ForwardQuery bool `json:"forward_query,omitempty"`
+	ForwardPath  bool `json:"forward_path,omitempty"`
+
+	Rules        []Rule        `json:"rules,omitempty"`
+	Destinations []Destination `json:"destinations,omitempty"`
+
+	ActiveFrom  *time.Time `json:"active_from,omitempty"`
+	ActiveUntil *time.Time `json:"active_until,omitempty"`
+	PendingURL  string     `json:"pending_url,omitempty"`
+	Fallbacks   []Fallback `json:"fallbacks,omitempty"`
+
+	Metadata *Metadata `json:"metadata,omitempty"`
+	Health   *Health   `json:"health,omitempty"`
+}
+
+func NewRez(record *InMemoryStorage) Rez {
+	return Rez{
+		ShortURL:  record.ShortURL,
+		LongURL:   record.LongURL,
+		Version:   record.Version,
+		ExpiresAt: record.ExpiresAt,
+
+		Clicks:     record.Clicks,
+		ClicksLeft: record.ClicksLeft,
+		Protected:  record.PasswordHash != "",
+
+		RedirectCode: record.RedirectCode,
+		ForwardQuery: record.ForwardQuery,
+		ForwardPath:  record.ForwardPath,
+
+		Rules:        record.Rules,
+		Destinations: record.Destinations,
+
+		ActiveFrom:  record.ActiveFrom,
+		ActiveUntil: record.ActiveUntil,
+		PendingURL:  record.PendingURL,
+		Fallbacks:   record.Fallbacks,
+
+		Metadata: record.Metadata,
+		Health:   record.Health,
+	}
 }
 
 var mu sync.Mutex
 
+// FindURL возвращает действующие ссылки пользователя: удалённые и истёкшие не попадают в список.
 func FindURL(input string) ([]Rez, error) {
 	mu.Lock()
 	defer mu.Unlock()
 	result := make([]Rez, 0, len(InMemoryCollection.ObjectURL))
+	now := time.Now()
 
 	if len(InMemoryCollection.ObjectURL) > 0 {
-		for _, record := range InMemoryCollection.ObjectURL {
-			if record.UserID == input {
-				prom := Rez{LongURL: record.LongURL, ShortURL: record.ShortURL}
-				result = append(result, prom)
+		for i, record := range InMemoryCollection.ObjectURL {
+			if record.UserID == input && !record.Flag && !record.Lapsed && !record.Expired(now) {
+				result = append(result, NewRez(&InMemoryCollection.ObjectURL[i]))
 			}
 		}
 	}
 
 	return result, nil
 }
+
+// consumeClick списывает переход и сообщает, изменилась ли запись.
+func consumeClick(records []InMemoryStorage, id string) (bool, error) {
+	for i := range records {
+		if !strings.EqualFold(records[i].ID, id) {
+			continue
+		}
+
+		// Ссылку могли удалить после поиска: переходов по ней больше нет
+		if records[i].Flag {
+			return false, ErrExhausted
+		}
+
+		left := records[i].ClicksLeft
+		if left == nil {
+			return false, nil
+		}
+		if *left <= 0 {
+			return false, ErrExhausted
+		}
+
+		// Новый указатель, чтобы не менять копии записи, выданные через findRecord
+		next := *left - 1
+		records[i].ClicksLeft = &next
+		return true, nil
+	}
+
+	return false, ErrNotFound
+}
+
+// expireRecords помечает истёкшими ссылки, срок которых истёк к моменту now.
+// Удалёнными они не становятся: просмотр и статистика отличают их от удалённых.
+func expireRecords(records []InMemoryStorage, now time.Time) int {
+	expired := 0
+	for i := range records {
+		if !records[i].Flag && !records[i].Lapsed && records[i].Expired(now) {
+			records[i].Lapsed = true
+			expired++
+		}
+	}
+	return expired
+}
+
+// updateLongURL меняет адрес назначения ссылки пользователя. Если адрес уже
+// сокращён другой ссылкой, запись не меняется и возвращается её короткий URL.
+func updateLongURL(records []InMemoryStorage, item *InMemoryStorage) (string, error) {
+	idx, err := ownedRecord(records, item.ID, item.UserID, item.Version)
+	if err != nil {
+		return "", err
+	}
+
+	for i, v := range records {
+		if i != idx && v.LongURL == item.LongURL {
+			return v.ShortURL, nil
+		}
+	}
+
+	rec := &records[idx]
+	if len(rec.History) == 0 {
+		// Запись создана до появления истории: сохраняем исходный адрес
+		rec.History = []Revision{{Version: 1, LongURL: rec.LongURL, ChangedBy: rec.UserID}}
+	}
+
+	rec.LongURL = item.LongURL
+	// Сведения и проверка относились к прежнему адресу
+	rec.Metadata = nil
+	rec.Health = nil
+	rec.Version++
+	rec.History = append(rec.History, Revision{
+		Version:   len(rec.History) + 1,
+		LongURL:   item.LongURL,
+		ChangedAt: time.Now().UTC(),
+		ChangedBy: item.UserID,
+	})
+
+	item.ShortURL = rec.ShortURL
+	item.Version = rec.Version
+	return "", nil
+}
+
+// setRules заменяет правила перенаправления ссылки пользователя и возвращает её новую версию.
+func setRules(records []InMemoryStorage, id, user string, version int64, rules []Rule) (int64, error) {
+	idx, err := ownedRecord(records, id, user, version)
+	if err != nil {
+		return 0, err
+	}
+
+	records[idx].Rules = rules
+	records[idx].Version++
+	return records[idx].Version, nil
+}
+
+// setDestinations заменяет варианты A/B-теста ссылки пользователя и возвращает её новую версию.
+func setDestinations(records []InMemoryStorage, id, user string, version int64, destinations []Destination) (int64, error) {
+	idx, err := ownedRecord(records, id, user, version)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range destinations {
+		destinations[i].Clicks = 0
+	}
+	records[idx].Destinations = destinations
+	records[idx].Version++
+	return records[idx].Version, nil
+}
+
+// countClicks добавляет переходы к счётчикам ссылок и вариантов и сообщает, изменилось ли
+// что-нибудь. Ссылки, которых уже нет, пропускаются, как и переходы к вариантам,
+// адрес которых сменился после перехода.
+func countClicks(records []InMemoryStorage, counts []ClickCount) bool {
+	changed := false
+	for _, c := range counts {
+		for i := range records {
+			if !strings.EqualFold(records[i].ID, c.LinkID) {
+				continue
+			}
+			records[i].Clicks += c.Clicks
+			changed = true
+			if c.Variant >= 0 && c.Variant < len(records[i].Destinations) && records[i].Destinations[c.Variant].URL == c.URL {
+				records[i].Destinations[c.Variant].Clicks += c.Clicks
+				changed = true
+			}
+			break
+		}
+	}
+	return changed
+}
+
+// countStats считает сводку по сервису.
+func countStats(records []InMemoryStorage) ServiceStats {
+	stats := ServiceStats{URLs: len(records)}
+	users := make(map[string]bool)
+	for _, v := range records {
+		if v.Flag {
+			stats.Deleted++
+			continue
+		}
+		if v.Lapsed {
+			stats.Expired++
+		}
+		users[v.UserID] = true
+	}
+	stats.Users = len(users)
+	return stats
+}
+
+// deleteRecord помечает удалённой одну ссылку пользователя.
+func deleteRecord(records []InMemoryStorage, id, user string, version int64) error {
+	idx, err := ownedRecord(records, id, user, version)
+	if err != nil {
+		return err
+	}
+
+	records[idx].Flag = true
+	records[idx].Version++
+	return nil
+}
+
+// ownedRecord ищет неудалённую ссылку пользователя и сверяет её версию.
+func ownedRecord(records []InMemoryStorage, id, user string, version int64) (int, error) {
+	for i, v := range records {
+		if !strings.EqualFold(v.ID, id) || v.UserID != user {
+			continue
+		}
+
+		switch {
+		case v.Flag:
+			return -1, ErrDeleted
+		case version != 0 && v.Version != version:
+			return -1, ErrVersionMismatch
+		}
+		return i, nil
+	}
+
+	return -1, ErrNotFound
+}
+
+// hasID сообщает, занят ли идентификатор. Поиск без учёта регистра, как в GetLongURL.
+func hasID(records []InMemoryStorage, id string) bool {
+	for _, v := range records {
+		if strings.EqualFold(v.ID, id) {
+			return true
+		}
+	}
+	return false
+}
+
+func findRecord(records []InMemoryStorage, id string) (*InMemoryStorage, error) {
+	for _, v := range records {
+		if strings.EqualFold(v.ID, id) {
+			rec := v
+			rec.History = append([]Revision(nil), v.History...)
+			return &rec, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+// startHistory записывает исходный адрес новой ссылки первой версией.
+func startHistory(item *InMemoryStorage) {
+	if item.CreatedAt.IsZero() {
+		item.CreatedAt = time.Now().UTC()
+	}
+	if len(item.History) > 0 {
+		return
+	}
+
+	item.History = []Revision{{
+		Version:   1,
+		LongURL:   item.LongURL,
+		ChangedAt: item.CreatedAt,
+		ChangedBy: item.UserID,
+	}}
+}
+
+// upgradeVersions присваивает первую версию записям, созданным до появления версий,
+// как это делает миграция базы. Иначе их ETag "0" нельзя передать в If-Match.
+func upgradeVersions(records []InMemoryStorage) {
+	for i := range records {
+		if records[i].Version == 0 {
+			records[i].Version = 1
+		}
+	}
+}
+
+func findHistory(records []InMemoryStorage, id, user string) ([]Revision, error) {
+	for _, v := range records {
+		if strings.EqualFold(v.ID, id) && v.UserID == user {
+			if len(v.History) == 0 {
+				return []Revision{{Version: 1, LongURL: v.LongURL, ChangedBy: v.UserID}}, nil
+			}
+			return append([]Revision(nil), v.History...), nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
@@ -0,0 +1,113 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"shortener/internal"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metadata — заголовок, описание и значок страницы, на которую ведёт ссылка.
+type Metadata struct {
+	Title       string    `json:"title,omitempty"`
+	Description string    `json:"description,omitempty"`
+	FaviconURL  string    `json:"favicon_url,omitempty"`
+	FetchedAt   time.Time `json:"fetched_at"`
+}
+
+// EnrichRequest — ссылка, для адреса которой нужно получить сведения о странице.
+type EnrichRequest struct {
+	ID      string
+	LongURL string
+}
+
+// EnrichHandler загружает сведения о страницах в workers потоков и сохраняет их
+// рядом со ссылками. Каждая загрузка ограничена timeout. Возвращается после
+// закрытия канала, когда все загрузки закончены.
+func EnrichHandler(storage Storage, enrichChan <-chan EnrichRequest, fetcher internal.MetadataFetcher, workers int, timeout time.Duration) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for req := range enrichChan {
+				enrich(storage, fetcher, req, timeout)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func enrich(storage Storage, fetcher internal.MetadataFetcher, req EnrichRequest, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	page, err := fetcher.Fetch(ctx, req.LongURL)
+	if err != nil {
+		log.Printf("Не удалось получить сведения о %s: %v", req.LongURL, err)
+		return
+	}
+
+	meta := Metadata{
+		Title:       page.Title,
+		Description: page.Description,
+		FaviconURL:  page.Favicon,
+		FetchedAt:   time.Now().UTC(),
+	}
+	if err := storage.SetMetadata(req.ID, req.LongURL, meta); err != nil {
+		log.Printf("Ошибка сохранения сведений о ссылке %s: %v", req.ID, err)
+	}
+}
+
+// setMetadata записывает сведения, если ссылка всё ещё ведёт на longURL:
+// пока страница загружалась, адрес могли поменять.
+func setMetadata(records []InMemoryStorage, id, longURL string, meta Metadata) bool {
+	for i := range records {
+		if !strings.EqualFold(records[i].ID, id) {
+			continue
+		}
+		if records[i].LongURL != longURL {
+			return false
+		}
+		records[i].Metadata = &meta
+		return true
+	}
+	return false
+}
+
+func (in *JSON) SetMetadata(id, longURL string, meta Metadata) error {
+	in.Lock()
+	defer in.Unlock()
+
+	setMetadata(InMemoryCollection.ObjectURL, id, longURL, meta)
+	return nil
+}
+
+func (fs *FileStorage) SetMetadata(id, longURL string, meta Metadata) error {
+	fs.addData.Lock()
+	defer fs.addData.Unlock()
+
+	obj, err := fs.readObjects()
+	if err != nil {
+		return err
+	}
+
+	if !setMetadata(obj.ObjectURL, id, longURL, meta) {
+		return nil
+	}
+
+	return fs.writeObjects(obj)
+}
+
+func (ds *DatabaseStorage) SetMetadata(id, longURL string, meta Metadata) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	_, err = ds.db.Exec(`UPDATE urls SET metadata = $1 WHERE lower(id) = lower($2) AND long_url = $3`, data, id, longURL)
+	return err
+}
@@ -3,9 +3,11 @@ package repository
 import (
 	"errors"
 	"fmt"
+	"log"
 	"shortener/internal/config"
 	"strings"
 	"sync"
+	"time"
 )
 
 type InMemoryStorage struct {
@@ -14,30 +16,184 @@ type InMemoryStorage struct {
 	ShortURL string `json:"short_url"`
 	UserID   string `json:"userID"`
 	Flag     bool   `json:"flag"`
+	Version  int64  `json:"version"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	History   []Revision `json:"history,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Lapsed — ссылку с истёкшим сроком пометил ExpireHandler. В отличие от Flag,
+	// её никто не удалял.
+	Lapsed bool `json:"lapsed,omitempty"`
+	// Clicks — сколько переходов записал ClickHandler за всё время.
+	Clicks int64 `json:"clicks,omitempty"`
+	// ClicksLeft — сколько переходов осталось; nil означает без ограничения.
+	ClicksLeft *int64 `json:"clicks_left,omitempty"`
+	// PasswordHash — солёный хэш пароля ссылки; пустой, если пароль не задан.
+	PasswordHash string `json:"password_hash,omitempty"`
+	// RedirectCode — код ответа при переходе; 0 означает код по умолчанию из конфигурации.
+	RedirectCode int `json:"redirect_code,omitempty"`
+	// ForwardQuery и ForwardPath передают адресу назначения параметры запроса и путь после идентификатора.
+	ForwardQuery bool `json:"forward_query,omitempty"`
+	ForwardPath  bool `json:"forward_path,omitempty"`
+	// Rules проверяются по порядку при каждом переходе; LongURL — адрес, если ни одно не подошло.
+	Rules []Rule `json:"rules,omitempty"`
+	// Destinations — варианты A/B-теста, между которыми посетители делятся по весу.
+	Destinations []Destination `json:"destinations,omitempty"`
+
+	// ActiveFrom и ActiveUntil задают окно, в котором по ссылке можно перейти.
+	ActiveFrom  *time.Time `json:"active_from,omitempty"`
+	ActiveUntil *time.Time `json:"active_until,omitempty"`
+	// PendingURL — куда вести посетителя до начала окна.
+	PendingURL string `json:"pending_url,omitempty"`
+	// Fallbacks — запасные адреса по порядку: переход идёт на первый рабочий,
+	// когда LongURL не прошёл проверку.
+	Fallbacks []Fallback `json:"fallbacks,omitempty"`
+
+	// Metadata заполняется в фоне после сохранения ссылки; nil — сведений ещё нет.
+	Metadata *Metadata `json:"metadata,omitempty"`
+	// Health — последняя проверка адреса назначения; nil — ещё не проверялся.
+	Health *Health `json:"health,omitempty"`
+}
+
+// Expired сообщает, истёк ли срок действия ссылки к моменту now.
+func (s *InMemoryStorage) Expired(now time.Time) bool {
+	return s.ExpiresAt != nil && !now.Before(*s.ExpiresAt)
+}
+
+// Scheduled сообщает, что окно ссылки к моменту now ещё не открылось.
+func (s *InMemoryStorage) Scheduled(now time.Time) bool {
+	return s.ActiveFrom != nil && now.Before(*s.ActiveFrom)
+}
+
+// Ended сообщает, что окно ссылки к моменту now уже закрылось.
+func (s *InMemoryStorage) Ended(now time.Time) bool {
+	return s.ActiveUntil != nil && !now.Before(*s.ActiveUntil)
+}
+
+// Revision — одна версия адреса назначения ссылки.
+type Revision struct {
+	Version   int       `json:"version"`
+	LongURL   string    `json:"original_url"`
+	ChangedAt time.Time `json:"changed_at"`
+	ChangedBy string    `json:"changed_by"`
+}
+
+// Rule выбирает адрес назначения по запросу. Правило подходит, когда
+// совпадают все заданные в нём условия.
+type Rule struct {
+	// Platform — платформа из User-Agent: ios, android, windows, macos, linux, mobile или desktop.
+	Platform string `json:"platform,omitempty"`
+	// Language — предпочитаемый язык из Accept-Language, например "ru" или "pt-BR".
+	Language string `json:"language,omitempty"`
+	// Country — код страны из заголовка, который выставляет балансировщик.
+	Country string `json:"country,omitempty"`
+	URL     string `json:"url"`
+	// Health — последняя проверка адреса правила; nil — ещё не проверялся.
+	Health *Health `json:"health,omitempty"`
+}
+
+// Destination — вариант адреса назначения в A/B-тесте.
+type Destination struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+	// Clicks — сколько переходов получил вариант.
+	Clicks int64 `json:"clicks"`
+	// Health — последняя проверка адреса варианта; nil — ещё не проверялся.
+	Health *Health `json:"health,omitempty"`
+}
+
+// ServiceStats — сводка по сервису для внутреннего мониторинга.
+type ServiceStats struct {
+	// URLs — все ссылки, включая удалённые.
+	URLs int `json:"urls"`
+	// Users — пользователи, у которых есть хотя бы одна неудалённая ссылка.
+	Users   int `json:"users"`
+	Deleted int `json:"deleted"`
+	// Expired — истёкшие ссылки, помеченные ExpireHandler; в Deleted они не входят.
+	Expired int `json:"expired"`
 }
 
 type JSON struct {
 	sync.Mutex
 	ObjectURL []InMemoryStorage
+	// Counter — последнее выданное значение счётчика идентификаторов.
+	Counter uint64 `json:"counter,omitempty"`
+	// Clicks — переходы хранилища в памяти; в файл ссылок не пишутся.
+	Clicks []Click `json:"-"`
 }
 
 var InMemoryCollection JSON
 
+var (
+	ErrNotFound = errors.New("URL не найден")
+	ErrDeleted  = errors.New("URL удалён")
+
+	ErrVersionMismatch = errors.New("версия записи не совпадает")
+	ErrIDCollision     = errors.New("идентификатор уже занят")
+	ErrExhausted       = errors.New("переходы по ссылке исчерпаны")
+)
+
 type DeleteRequest struct {
 	UserID string   // Идентификатор пользователя
 	URLs   []string // Список URL для удаления
 }
 
 type Storage interface {
+	// SaveURL возвращает ErrIDCollision, если ссылка с таким же идентификатором уже есть.
 	SaveURL(longURL *InMemoryStorage) (sortURL string, err error)
 	GetLongURL(id string) (longURL string, flag bool, err error)
+	GetURL(id string) (*InMemoryStorage, error)
+	// GetUserURLs возвращает действующие ссылки пользователя.
+	GetUserURLs(user string) ([]Rez, error)
 	DeleteURL(ids []string, user string) error
+	// DeleteByID удаляет ссылку пользователя, если её версия равна version (0 — без проверки).
+	DeleteByID(id, user string, version int64) error
+	// UpdateURL меняет адрес ссылки item.ID на item.LongURL, если её версия равна
+	// item.Version (0 — без проверки). После изменения в item записывается новая версия.
+	UpdateURL(item *InMemoryStorage) (shortURL string, err error)
+	GetHistory(id, user string) ([]Revision, error)
+	// NextSequence выдаёт следующее значение счётчика для генератора counter.
+	NextSequence() (uint64, error)
+	// ExpireURLs помечает истёкшими ссылки, срок которых истёк к моменту now.
+	ExpireURLs(now time.Time) (int, error)
+	// ConsumeClick атомарно списывает переход у ссылки с ограничением переходов
+	// и возвращает ErrExhausted, когда они закончились.
+	ConsumeClick(id string) error
+	// SetRules заменяет правила перенаправления ссылки пользователя, если её версия
+	// равна version (0 — без проверки), и возвращает новую версию.
+	SetRules(id, user string, version int64, rules []Rule) (int64, error)
+	// SetDestinations заменяет варианты A/B-теста ссылки пользователя и обнуляет их
+	// счётчики. Версия проверяется и возвращается так же, как в SetRules.
+	SetDestinations(id, user string, version int64, destinations []Destination) (int64, error)
+	// SetFallbacks заменяет запасные адреса ссылки пользователя. Версия проверяется
+	// и возвращается так же, как в SetRules.
+	SetFallbacks(id, user string, version int64, fallbacks []Fallback) (int64, error)
+	// CountClicks добавляет переходы к счётчикам ссылок и вариантов A/B-теста.
+	CountClicks(counts []ClickCount) error
+	// SaveClicks записывает пачку событий переходов.
+	SaveClicks(clicks []Click) error
+	// GetClicks возвращает переходы по ссылке id за [from, to).
+	GetClicks(id string, from, to time.Time) ([]Click, error)
+	// SetMetadata сохраняет сведения о странице, если ссылка id всё ещё ведёт на longURL.
+	SetMetadata(id, longURL string, meta Metadata) error
+	// ActiveURLs возвращает ссылки, которые не удалены и не истекли к моменту now.
+	ActiveURLs(now time.Time) ([]InMemoryStorage, error)
+	// SetHealth сохраняет проверки адресов ссылок за один раунд одной записью.
+	// Адрес, которого у ссылки уже нет, пропускается.
+	SetHealth(results []HealthResult) error
+	// Stats возвращает сводные числа по всему сервису.
+	Stats() (ServiceStats, error)
 	Ping(config *config.Config) error
 }
 
 func (in *JSON) SaveURL(longURL *InMemoryStorage) (sortURL string, err error) {
 	in.Lock()
 	defer in.Unlock()
+	if hasID(InMemoryCollection.ObjectURL, longURL.ID) {
+		return "", ErrIDCollision
+	}
+	startHistory(longURL)
+	longURL.Version = 1
 	InMemoryCollection.ObjectURL = append(InMemoryCollection.ObjectURL, *longURL)
 	return "", nil
 }
@@ -70,6 +226,7 @@ func (in *JSON) DeleteURL(ids []string, user string) error {
 		for _, id := range ids {
 			if strings.EqualFold(v.ID, id) && v.UserID == user {
 				InMemoryCollection.ObjectURL[i].Flag = true
+				InMemoryCollection.ObjectURL[i].Version++
 				deleted = true
 				break
 			}
@@ -82,10 +239,115 @@ func (in *JSON) DeleteURL(ids []string, user string) error {
 	return nil
 }
 
+func (in *JSON) GetURL(id string) (*InMemoryStorage, error) {
+	in.Lock()
+	defer in.Unlock()
+
+	return findRecord(InMemoryCollection.ObjectURL, id)
+}
+
+func (in *JSON) GetUserURLs(user string) ([]Rez, error) {
+	in.Lock()
+	defer in.Unlock()
+
+	return FindURL(user)
+}
+
+func (in *JSON) ExpireURLs(now time.Time) (int, error) {
+	in.Lock()
+	defer in.Unlock()
+
+	return expireRecords(InMemoryCollection.ObjectURL, now), nil
+}
+
+func (in *JSON) ConsumeClick(id string) error {
+	in.Lock()
+	defer in.Unlock()
+
+	_, err := consumeClick(InMemoryCollection.ObjectURL, id)
+	return err
+}
+
+func (in *JSON) UpdateURL(item *InMemoryStorage) (string, error) {
+	in.Lock()
+	defer in.Unlock()
+
+	return updateLongURL(InMemoryCollection.ObjectURL, item)
+}
+
+func (in *JSON) SetRules(id, user string, version int64, rules []Rule) (int64, error) {
+	in.Lock()
+	defer in.Unlock()
+
+	return setRules(InMemoryCollection.ObjectURL, id, user, version, rules)
+}
+
+func (in *JSON) SetDestinations(id, user string, version int64, destinations []Destination) (int64, error) {
+	in.Lock()
+	defer in.Unlock()
+
+	return setDestinations(InMemoryCollection.ObjectURL, id, user, version, destinations)
+}
+
+func (in *JSON) CountClicks(counts []ClickCount) error {
+	in.Lock()
+	defer in.Unlock()
+
+	countClicks(InMemoryCollection.ObjectURL, counts)
+	return nil
+}
+
+func (in *JSON) Stats() (ServiceStats, error) {
+	in.Lock()
+	defer in.Unlock()
+
+	return countStats(InMemoryCollection.ObjectURL), nil
+}
+
+func (in *JSON) DeleteByID(id, user string, version int64) error {
+	in.Lock()
+	defer in.Unlock()
+
+	return deleteRecord(InMemoryCollection.ObjectURL, id, user, version)
+}
+
+func (in *JSON) GetHistory(id, user string) ([]Revision, error) {
+	in.Lock()
+	defer in.Unlock()
+
+	return findHistory(InMemoryCollection.ObjectURL, id, user)
+}
+
+func (in *JSON) NextSequence() (uint64, error) {
+	in.Lock()
+	defer in.Unlock()
+
+	InMemoryCollection.Counter++
+	return InMemoryCollection.Counter, nil
+}
+
 func (in *JSON) Ping(config *config.Config) error {
 	return nil
 }
 
+// ExpireHandler раз в interval помечает истёкшими ссылки с прошедшим сроком,
+// чтобы они пропали из списка ссылок пользователя.
+func ExpireHandler(storage Storage, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		expired, err := storage.ExpireURLs(now)
+		if err != nil {
+			log.Printf("Ошибка при пометке истёкших URL: %v", err)
+			continue
+		}
+		if expired > 0 {
+			log.Printf("Помечено истёкших URL: %d", expired)
+		}
+	}
+}
+
 func DeleteHandler(storage Storage, deleteChan chan DeleteRequest, wg *sync.WaitGroup) {
 	for req := range deleteChan {
 		userID := req.UserID
@@ -2,13 +2,24 @@ package repository
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/lib/pq"
 	"log"
 	"shortener/internal/config"
+	"strconv"
+	"time"
 )
 
+// Код ошибки Postgres при нарушении ограничения уникальности.
+const uniqueViolation = "23505"
+
+const insertHistoryQuery = `
+	INSERT INTO url_history (url_id, version, long_url, changed_by)
+	VALUES ($1, $2, $3, $4)
+`
+
 type DatabaseStorage struct {
 	db *sql.DB
 }
@@ -21,8 +32,8 @@ func NewDatabaseStorage(db *sql.DB) *DatabaseStorage {
 
 func (ds *DatabaseStorage) SaveURL(item *InMemoryStorage) (string, error) {
 	insertQuery := `
-		INSERT INTO urls (id, long_url, short_url, user_id, flag)
-		VALUES ($1, $2, $3, $4, $5)
+		INSERT INTO urls (id, long_url, short_url, user_id, flag, expires_at, clicks_left, password_hash, redirect_code, forward_query, forward_path, created_at, rules, destinations, active_from, active_until, pending_url, fallbacks)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18)
 		ON CONFLICT (long_url) DO NOTHING
 	`
 
@@ -30,10 +41,48 @@ func (ds *DatabaseStorage) SaveURL(item *InMemoryStorage) (string, error) {
 		SELECT short_url FROM urls WHERE long_url = $1
 	`
 
-	_, err := ds.db.Exec(insertQuery, item.ID, item.LongURL, item.ShortURL, item.UserID, item.Flag)
+	if item.CreatedAt.IsZero() {
+		item.CreatedAt = time.Now().UTC()
+	}
+	rules, err := marshalRules(item.Rules)
+	if err != nil {
+		return "", err
+	}
+	destinations, err := marshalDestinations(item.Destinations)
+	if err != nil {
+		return "", err
+	}
+	fallbacks, err := marshalFallbacks(item.Fallbacks)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := ds.db.Begin()
 	if err != nil {
 		return "", err
 	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(insertQuery, item.ID, item.LongURL, item.ShortURL, item.UserID, item.Flag, item.ExpiresAt, item.ClicksLeft, item.PasswordHash, item.RedirectCode, item.ForwardQuery, item.ForwardPath, item.CreatedAt, rules, destinations, item.ActiveFrom, item.ActiveUntil, item.PendingURL, fallbacks)
+	if err != nil {
+		// Конфликт по long_url гасит ON CONFLICT, значит занят идентификатор
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+			return "", ErrIDCollision
+		}
+		return "", err
+	}
+
+	// Первая версия истории пишется только для действительно добавленной ссылки
+	if rows, _ := res.RowsAffected(); rows == 1 {
+		if _, err = tx.Exec(insertHistoryQuery, item.ID, 1, item.LongURL, item.UserID); err != nil {
+			return "", err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
 
 	var shortURL string
 	err = ds.db.QueryRow(getShortURL, item.LongURL).Scan(&shortURL)
@@ -54,7 +103,7 @@ func (ds *DatabaseStorage) GetLongURL(id string) (string, bool, error) {
 	var flag bool
 
 	selectQuery := `
-		SELECT long_url, flag  FROM urls WHERE id = $1
+		SELECT long_url, flag  FROM urls WHERE lower(id) = lower($1)
 	`
 
 	err := ds.db.QueryRow(selectQuery, id).Scan(&longURL, &flag)
@@ -75,8 +124,8 @@ func (ds *DatabaseStorage) DeleteURL(ids []string, user string) error {
 
 	query := `
         UPDATE urls
-        SET flag = true
-        WHERE user_id = $1 AND id = ANY($2)
+        SET flag = true, version = version + 1
+        WHERE user_id = $1 AND lower(id) = ANY(SELECT lower(x) FROM unnest($2::text[]) AS x) AND NOT flag
     `
 
 	_, err := ds.db.Exec(query, user, pq.Array(ids))
@@ -87,6 +136,395 @@ func (ds *DatabaseStorage) DeleteURL(ids []string, user string) error {
 	return nil
 }
 
+func (ds *DatabaseStorage) GetURL(id string) (*InMemoryStorage, error) {
+	selectQuery := `SELECT ` + urlColumns + ` FROM urls WHERE lower(id) = lower($1)`
+
+	item, err := scanURL(ds.db.QueryRow(selectQuery, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+func (ds *DatabaseStorage) GetUserURLs(user string) ([]Rez, error) {
+	selectQuery := `
+		SELECT ` + urlColumns + ` FROM urls
+		WHERE user_id = $1 AND NOT flag AND NOT lapsed AND (expires_at IS NULL OR expires_at > now())
+	`
+
+	rows, err := ds.db.Query(selectQuery, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]Rez, 0)
+	for rows.Next() {
+		item, err := scanURL(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, NewRez(item))
+	}
+
+	return result, rows.Err()
+}
+
+func (ds *DatabaseStorage) ExpireURLs(now time.Time) (int, error) {
+	query := `
+		UPDATE urls SET lapsed = true
+		WHERE NOT flag AND NOT lapsed AND expires_at <= $1
+	`
+
+	res, err := ds.db.Exec(query, now)
+	if err != nil {
+		return 0, err
+	}
+
+	expired, err := res.RowsAffected()
+	return int(expired), err
+}
+
+func (ds *DatabaseStorage) ConsumeClick(id string) error {
+	// Проверка остатка и списание в одном UPDATE, поэтому параллельные переходы не уйдут в минус
+	query := `
+		UPDATE urls SET clicks_left = clicks_left - 1
+		WHERE lower(id) = lower($1) AND NOT flag AND (clicks_left IS NULL OR clicks_left > 0)
+		RETURNING id
+	`
+
+	var storedID string
+	err := ds.db.QueryRow(query, id).Scan(&storedID)
+	if errors.Is(err, sql.ErrNoRows) {
+		if _, err := ds.GetURL(id); err != nil {
+			return err
+		}
+		return ErrExhausted
+	}
+	return err
+}
+
+// urlColumns — столбцы urls в порядке, который читает scanURL.
+const urlColumns = `id, long_url, short_url, user_id, flag, version, expires_at, lapsed, clicks, clicks_left, password_hash, redirect_code, forward_query, forward_path, created_at, rules, destinations, active_from, active_until, pending_url, metadata, health, fallbacks`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanURL(row rowScanner) (*InMemoryStorage, error) {
+	var item InMemoryStorage
+	var expiresAt sql.NullTime
+	var clicksLeft sql.NullInt64
+	var createdAt, activeFrom, activeUntil sql.NullTime
+	var rules, destinations, metadata, health, fallbacks []byte
+
+	err := row.Scan(&item.ID, &item.LongURL, &item.ShortURL, &item.UserID, &item.Flag, &item.Version, &expiresAt, &item.Lapsed, &item.Clicks, &clicksLeft, &item.PasswordHash, &item.RedirectCode, &item.ForwardQuery, &item.ForwardPath, &createdAt, &rules, &destinations, &activeFrom, &activeUntil, &item.PendingURL, &metadata, &health, &fallbacks)
+	if err != nil {
+		return nil, err
+	}
+
+	if expiresAt.Valid {
+		item.ExpiresAt = &expiresAt.Time
+	}
+	if clicksLeft.Valid {
+		item.ClicksLeft = &clicksLeft.Int64
+	}
+	// Ссылки, созданные до появления столбца, даты создания не имеют
+	if createdAt.Valid {
+		item.CreatedAt = createdAt.Time
+	}
+	if activeFrom.Valid {
+		item.ActiveFrom = &activeFrom.Time
+	}
+	if activeUntil.Valid {
+		item.ActiveUntil = &activeUntil.Time
+	}
+	if err := json.Unmarshal(rules, &item.Rules); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(destinations, &item.Destinations); err != nil {
+		return nil, err
+	}
+	if metadata != nil {
+		if err := json.Unmarshal(metadata, &item.Metadata); err != nil {
+			return nil, err
+		}
+	}
+	if health != nil {
+		if err := json.Unmarshal(health, &item.Health); err != nil {
+			return nil, err
+		}
+	}
+	if err := json.Unmarshal(fallbacks, &item.Fallbacks); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// marshalRules записывает правила в JSON для столбца rules; пустой список — "[]".
+func marshalRules(rules []Rule) ([]byte, error) {
+	if rules == nil {
+		rules = []Rule{}
+	}
+	return json.Marshal(rules)
+}
+
+func (ds *DatabaseStorage) SetRules(id, user string, version int64, rules []Rule) (int64, error) {
+	data, err := marshalRules(rules)
+	if err != nil {
+		return 0, err
+	}
+
+	updateQuery := `
+		UPDATE urls SET rules = $1, version = version + 1
+		WHERE lower(id) = lower($2) AND user_id = $3 AND NOT flag AND ($4::bigint = 0 OR version = $4)
+		RETURNING version
+	`
+
+	var newVersion int64
+	err = ds.db.QueryRow(updateQuery, data, id, user, version).Scan(&newVersion)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ds.missing(id, user, version)
+	}
+	return newVersion, err
+}
+
+func marshalDestinations(destinations []Destination) ([]byte, error) {
+	if destinations == nil {
+		destinations = []Destination{}
+	}
+	return json.Marshal(destinations)
+}
+
+func (ds *DatabaseStorage) SetDestinations(id, user string, version int64, destinations []Destination) (int64, error) {
+	for i := range destinations {
+		destinations[i].Clicks = 0
+	}
+	data, err := marshalDestinations(destinations)
+	if err != nil {
+		return 0, err
+	}
+
+	updateQuery := `
+		UPDATE urls SET destinations = $1, version = version + 1
+		WHERE lower(id) = lower($2) AND user_id = $3 AND NOT flag AND ($4::bigint = 0 OR version = $4)
+		RETURNING version
+	`
+
+	var newVersion int64
+	err = ds.db.QueryRow(updateQuery, data, id, user, version).Scan(&newVersion)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ds.missing(id, user, version)
+	}
+	return newVersion, err
+}
+
+// CountClicks увеличивает счётчики внутри JSONB, а не переписывает список,
+// чтобы не затереть одновременную запись. Пачка применяется в одной транзакции.
+func (ds *DatabaseStorage) CountClicks(counts []ClickCount) error {
+	query := `
+		UPDATE urls SET clicks = clicks + $4,
+			destinations = CASE WHEN $3::int >= 0 AND destinations -> $3::int ->> 'url' = $5
+				THEN jsonb_set(destinations, ARRAY[$2::text, 'clicks'],
+					to_jsonb(COALESCE((destinations -> $3::int ->> 'clicks')::bigint, 0) + $4))
+				ELSE destinations END
+		WHERE lower(id) = lower($1)
+	`
+
+	tx, err := ds.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, c := range counts {
+		if _, err := tx.Exec(query, c.LinkID, strconv.Itoa(c.Variant), c.Variant, c.Clicks, c.URL); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Stats считает сводку одним проходом по таблице.
+func (ds *DatabaseStorage) Stats() (ServiceStats, error) {
+	query := `
+		SELECT count(*), count(DISTINCT user_id) FILTER (WHERE NOT flag), count(*) FILTER (WHERE flag),
+			count(*) FILTER (WHERE lapsed AND NOT flag)
+		FROM urls
+	`
+
+	var stats ServiceStats
+	err := ds.db.QueryRow(query).Scan(&stats.URLs, &stats.Users, &stats.Deleted, &stats.Expired)
+	return stats, err
+}
+
+func (ds *DatabaseStorage) DeleteByID(id, user string, version int64) error {
+	query := `
+		UPDATE urls SET flag = true, version = version + 1
+		WHERE lower(id) = lower($1) AND user_id = $2 AND NOT flag AND ($3::bigint = 0 OR version = $3)
+	`
+
+	res, err := ds.db.Exec(query, id, user, version)
+	if err != nil {
+		return err
+	}
+
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ds.missing(id, user, version)
+	}
+
+	return nil
+}
+
+func (ds *DatabaseStorage) UpdateURL(item *InMemoryStorage) (string, error) {
+	id, user, longURL := item.ID, item.UserID, item.LongURL
+
+	updateQuery := `
+		UPDATE urls SET long_url = $1, metadata = NULL, health = NULL, version = version + 1
+		WHERE lower(id) = lower($2) AND user_id = $3 AND NOT flag AND ($4::bigint = 0 OR version = $4)
+		RETURNING id, short_url, version
+	`
+
+	getShortURL := `
+		SELECT short_url FROM urls WHERE long_url = $1
+	`
+
+	// Ссылки, созданные до появления истории, получают исходный адрес первой версией
+	backfillQuery := `
+		INSERT INTO url_history (url_id, version, long_url, changed_at, changed_by)
+		SELECT id, 1, long_url, NULL, user_id FROM urls
+		WHERE lower(id) = lower($1) AND user_id = $2 AND NOT flag
+		  AND NOT EXISTS (SELECT 1 FROM url_history WHERE url_id = urls.id)
+	`
+
+	tx, err := ds.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(backfillQuery, id, user); err != nil {
+		return "", err
+	}
+
+	var shortURL string
+	var version int64
+	// Идентификатор ищется без учёта регистра, в историю пишется сохранённый
+	var storedID string
+	err = tx.QueryRow(updateQuery, longURL, id, user, item.Version).Scan(&storedID, &shortURL, &version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ds.missing(id, user, item.Version)
+	}
+	if err != nil {
+		// Адрес уже сокращён другой ссылкой — отдаём её, как и SaveURL
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+			err = ds.db.QueryRow(getShortURL, longURL).Scan(&shortURL)
+			return shortURL, err
+		}
+		return "", err
+	}
+
+	nextVersion := `
+		INSERT INTO url_history (url_id, version, long_url, changed_by)
+		SELECT $1, COALESCE(MAX(version), 0) + 1, $2, $3 FROM url_history WHERE url_id = $1
+	`
+	if _, err = tx.Exec(nextVersion, storedID, longURL, user); err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", err
+	}
+
+	item.ShortURL = shortURL
+	item.Version = version
+	return "", nil
+}
+
+func (ds *DatabaseStorage) GetHistory(id, user string) ([]Revision, error) {
+	selectQuery := `
+		SELECT h.version, h.long_url, h.changed_at, h.changed_by
+		FROM url_history h JOIN urls u ON u.id = h.url_id
+		WHERE lower(u.id) = lower($1) AND u.user_id = $2
+		ORDER BY h.version
+	`
+
+	rows, err := ds.db.Query(selectQuery, id, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []Revision
+	for rows.Next() {
+		var rev Revision
+		var changedAt sql.NullTime
+		if err := rows.Scan(&rev.Version, &rev.LongURL, &changedAt, &rev.ChangedBy); err != nil {
+			return nil, err
+		}
+		rev.ChangedAt = changedAt.Time
+		history = append(history, rev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(history) > 0 {
+		return history, nil
+	}
+
+	// Истории нет: ссылка либо чужая, либо создана до её появления
+	var longURL string
+	err = ds.db.QueryRow(`SELECT long_url FROM urls WHERE lower(id) = lower($1) AND user_id = $2`, id, user).Scan(&longURL)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return []Revision{{Version: 1, LongURL: longURL, ChangedBy: user}}, nil
+}
+
+// missing объясняет, почему запрос не затронул ни одной строки ссылки пользователя.
+func (ds *DatabaseStorage) missing(id, user string, version int64) error {
+	var flag bool
+	var current int64
+	err := ds.db.QueryRow(`SELECT flag, version FROM urls WHERE lower(id) = lower($1) AND user_id = $2`, id, user).Scan(&flag, &current)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case flag:
+		return ErrDeleted
+	case version != 0 && current != version:
+		return ErrVersionMismatch
+	}
+	return ErrNotFound
+}
+
+func (ds *DatabaseStorage) NextSequence() (uint64, error) {
+	var n int64
+	if err := ds.db.QueryRow(`SELECT nextval('urls_counter_seq')`).Scan(&n); err != nil {
+		return 0, err
+	}
+	return uint64(n), nil
+}
+
 func (ds *DatabaseStorage) Ping(config *config.Config) error {
 
 	err := ds.db.Ping()
@@ -99,7 +537,7 @@ func (ds *DatabaseStorage) Ping(config *config.Config) error {
 }
 
 func createURLsTable(db *sql.DB) error {
-	createTableQuery := `
+	createTableQueries := []string{`
 		CREATE TABLE IF NOT EXISTS urls (
 			id VARCHAR(36) PRIMARY KEY,
 			long_url TEXT UNIQUE NOT NULL,
@@ -107,10 +545,75 @@ func createURLsTable(db *sql.DB) error {
 			user_id VARCHAR(36) NOT NULL,
 		    flag BOOLEAN NOT NULL
 		)
-	`
+	`, `
+		CREATE TABLE IF NOT EXISTS url_history (
+			url_id VARCHAR(36) NOT NULL REFERENCES urls (id),
+			version INTEGER NOT NULL,
+			long_url TEXT NOT NULL,
+			changed_at TIMESTAMPTZ DEFAULT now(),
+			changed_by VARCHAR(36) NOT NULL,
+			PRIMARY KEY (url_id, version)
+		)
+	`, `
+		ALTER TABLE urls ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1
+	`, `
+		CREATE UNIQUE INDEX IF NOT EXISTS urls_id_lower_idx ON urls (lower(id))
+	`, `
+		CREATE SEQUENCE IF NOT EXISTS urls_counter_seq
+	`, `
+		ALTER TABLE urls ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ
+	`, `
+		ALTER TABLE urls ADD COLUMN IF NOT EXISTS clicks_left BIGINT
+	`, `
+		ALTER TABLE urls ADD COLUMN IF NOT EXISTS password_hash TEXT NOT NULL DEFAULT ''
+	`, `
+		ALTER TABLE urls ADD COLUMN IF NOT EXISTS redirect_code INTEGER NOT NULL DEFAULT 0
+	`, `
+		ALTER TABLE urls ADD COLUMN IF NOT EXISTS forward_query BOOLEAN NOT NULL DEFAULT false
+	`, `
+		ALTER TABLE urls ADD COLUMN IF NOT EXISTS forward_path BOOLEAN NOT NULL DEFAULT false
+	`, `
+		ALTER TABLE urls ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ
+	`, `
+		ALTER TABLE urls ADD COLUMN IF NOT EXISTS rules JSONB NOT NULL DEFAULT '[]'
+	`, `
+		ALTER TABLE urls ADD COLUMN IF NOT EXISTS destinations JSONB NOT NULL DEFAULT '[]'
+	`, `
+		ALTER TABLE urls ADD COLUMN IF NOT EXISTS active_from TIMESTAMPTZ
+	`, `
+		ALTER TABLE urls ADD COLUMN IF NOT EXISTS active_until TIMESTAMPTZ
+	`, `
+		ALTER TABLE urls ADD COLUMN IF NOT EXISTS pending_url TEXT NOT NULL DEFAULT ''
+	`, `
+		ALTER TABLE urls ADD COLUMN IF NOT EXISTS metadata JSONB
+	`, `
+		ALTER TABLE urls ADD COLUMN IF NOT EXISTS health JSONB
+	`, `
+		ALTER TABLE urls ADD COLUMN IF NOT EXISTS fallbacks JSONB NOT NULL DEFAULT '[]'
+	`, `
+		ALTER TABLE urls ADD COLUMN IF NOT EXISTS lapsed BOOLEAN NOT NULL DEFAULT false
+	`, `
+		ALTER TABLE urls ADD COLUMN IF NOT EXISTS clicks BIGINT NOT NULL DEFAULT 0
+	`, `
+		CREATE TABLE IF NOT EXISTS clicks (
+			id BIGSERIAL PRIMARY KEY,
+			url_id VARCHAR(36) NOT NULL,
+			clicked_at TIMESTAMPTZ NOT NULL,
+			referrer TEXT NOT NULL DEFAULT '',
+			user_agent TEXT NOT NULL DEFAULT '',
+			ip TEXT NOT NULL DEFAULT '',
+			variant INTEGER NOT NULL DEFAULT -1
+		)
+	`, `
+		CREATE INDEX IF NOT EXISTS clicks_url_time_idx ON clicks (url_id, clicked_at)
+	`}
 
-	_, err := db.Exec(createTableQuery)
-	return err
+	for _, query := range createTableQueries {
+		if _, err := db.Exec(query); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func CheckBD(databaseDSN string) error {
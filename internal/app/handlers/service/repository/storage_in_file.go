@@ -10,11 +10,19 @@ import (
 	"shortener/internal/config"
 	"strings"
 	"sync"
+	"time"
 )
 
+// counterBlock — сколько значений счётчика резервируется одной записью в файл.
+const counterBlock = 100
+
 type FileStorage struct {
 	filename string
 	addData  sync.Mutex
+	clicks   sync.Mutex
+
+	// Зарезервированный в файле диапазон счётчика (next, reserved]
+	next, reserved uint64
 }
 
 func NewFileStorage(filename string) *FileStorage {
@@ -71,6 +79,12 @@ func (fs *FileStorage) SaveURL(longURL *InMemoryStorage) (shortURL string, err e
 	InMemoryCollection.Mutex.Lock()
 	defer InMemoryCollection.Mutex.Unlock()
 
+	if hasID(obj.ObjectURL, longURL.ID) {
+		return "", ErrIDCollision
+	}
+
+	startHistory(longURL)
+	longURL.Version = 1
 	obj.ObjectURL = append(obj.ObjectURL, *longURL)
 	InMemoryCollection.ObjectURL = append(InMemoryCollection.ObjectURL, *longURL)
 
@@ -88,30 +102,18 @@ func (fs *FileStorage) DeleteURL(ids []string, user string) error {
 	fs.addData.Lock()
 	defer fs.addData.Unlock()
 
-	// Открываем файл для чтения и записи
-	file, err := os.OpenFile(fs.filename, os.O_RDWR, 0644)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	// Читаем содержимое файла
-	jsonData, err := os.ReadFile(fs.filename)
+	obj, err := fs.readObjects()
 	if err != nil {
 		return err
 	}
 
-	var obj JSON
-	if err := json.Unmarshal(jsonData, &obj); err != nil {
-		return err
-	}
-
 	deleted := false
 
 	for i, url := range obj.ObjectURL {
 		for _, id := range ids {
-			if url.ID == id && url.UserID == user {
+			if strings.EqualFold(url.ID, id) && url.UserID == user {
 				obj.ObjectURL[i].Flag = true
+				obj.ObjectURL[i].Version++
 				deleted = true
 				break
 			}
@@ -122,15 +124,218 @@ func (fs *FileStorage) DeleteURL(ids []string, user string) error {
 		return errors.New("URL-ы не найдены для удаления")
 	}
 
-	updatedData, err := json.Marshal(&obj)
+	return fs.writeObjects(obj)
+}
+
+func (fs *FileStorage) GetURL(id string) (*InMemoryStorage, error) {
+	InMemoryCollection.Mutex.Lock()
+	defer InMemoryCollection.Mutex.Unlock()
+
+	return findRecord(InMemoryCollection.ObjectURL, id)
+}
+
+func (fs *FileStorage) GetUserURLs(user string) ([]Rez, error) {
+	InMemoryCollection.Mutex.Lock()
+	defer InMemoryCollection.Mutex.Unlock()
+
+	return FindURL(user)
+}
+
+func (fs *FileStorage) ExpireURLs(now time.Time) (int, error) {
+	fs.addData.Lock()
+	defer fs.addData.Unlock()
+
+	obj, err := fs.readObjects()
+	if err != nil {
+		return 0, err
+	}
+
+	expired := expireRecords(obj.ObjectURL, now)
+	if expired == 0 {
+		return 0, nil
+	}
+
+	return expired, fs.writeObjects(obj)
+}
+
+func (fs *FileStorage) ConsumeClick(id string) error {
+	fs.addData.Lock()
+	defer fs.addData.Unlock()
+
+	obj, err := fs.readObjects()
+	if err != nil {
+		return err
+	}
+
+	changed, err := consumeClick(obj.ObjectURL, id)
+	if err != nil || !changed {
+		return err
+	}
+
+	return fs.writeObjects(obj)
+}
+
+func (fs *FileStorage) UpdateURL(item *InMemoryStorage) (string, error) {
+	fs.addData.Lock()
+	defer fs.addData.Unlock()
+
+	obj, err := fs.readObjects()
+	if err != nil {
+		return "", err
+	}
+
+	short, err := updateLongURL(obj.ObjectURL, item)
+	if err != nil || short != "" {
+		return short, err
+	}
+
+	return "", fs.writeObjects(obj)
+}
+
+func (fs *FileStorage) SetRules(id, user string, version int64, rules []Rule) (int64, error) {
+	fs.addData.Lock()
+	defer fs.addData.Unlock()
+
+	obj, err := fs.readObjects()
+	if err != nil {
+		return 0, err
+	}
+
+	newVersion, err := setRules(obj.ObjectURL, id, user, version, rules)
+	if err != nil {
+		return 0, err
+	}
+
+	return newVersion, fs.writeObjects(obj)
+}
+
+func (fs *FileStorage) SetDestinations(id, user string, version int64, destinations []Destination) (int64, error) {
+	fs.addData.Lock()
+	defer fs.addData.Unlock()
+
+	obj, err := fs.readObjects()
+	if err != nil {
+		return 0, err
+	}
+
+	newVersion, err := setDestinations(obj.ObjectURL, id, user, version, destinations)
+	if err != nil {
+		return 0, err
+	}
+
+	return newVersion, fs.writeObjects(obj)
+}
+
+// CountClicks переписывает файл ссылок один раз на всю пачку.
+func (fs *FileStorage) CountClicks(counts []ClickCount) error {
+	fs.addData.Lock()
+	defer fs.addData.Unlock()
+
+	obj, err := fs.readObjects()
 	if err != nil {
 		return err
 	}
 
-	if _, err := file.WriteAt(updatedData, 0); err != nil {
+	if !countClicks(obj.ObjectURL, counts) {
+		return nil
+	}
+
+	return fs.writeObjects(obj)
+}
+
+func (fs *FileStorage) Stats() (ServiceStats, error) {
+	fs.addData.Lock()
+	defer fs.addData.Unlock()
+
+	obj, err := fs.readObjects()
+	if err != nil {
+		return ServiceStats{}, err
+	}
+
+	return countStats(obj.ObjectURL), nil
+}
+
+func (fs *FileStorage) DeleteByID(id, user string, version int64) error {
+	fs.addData.Lock()
+	defer fs.addData.Unlock()
+
+	obj, err := fs.readObjects()
+	if err != nil {
 		return err
 	}
 
+	if err := deleteRecord(obj.ObjectURL, id, user, version); err != nil {
+		return err
+	}
+
+	return fs.writeObjects(obj)
+}
+
+func (fs *FileStorage) GetHistory(id, user string) ([]Revision, error) {
+	InMemoryCollection.Mutex.Lock()
+	defer InMemoryCollection.Mutex.Unlock()
+
+	return findHistory(InMemoryCollection.ObjectURL, id, user)
+}
+
+func (fs *FileStorage) NextSequence() (uint64, error) {
+	fs.addData.Lock()
+	defer fs.addData.Unlock()
+
+	// Файл переписывается раз на блок, после перезапуска остаток блока пропускается
+	if fs.next == fs.reserved {
+		obj, err := fs.readObjects()
+		if err != nil {
+			return 0, err
+		}
+
+		start := obj.Counter
+		obj.Counter += counterBlock
+		if err := fs.writeObjects(obj); err != nil {
+			return 0, err
+		}
+		fs.next, fs.reserved = start, obj.Counter
+	}
+
+	fs.next++
+	return fs.next, nil
+}
+
+// readObjects читает все записи из файла хранилища.
+func (fs *FileStorage) readObjects() (*JSON, error) {
+	jsonData, err := os.ReadFile(fs.filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	obj := &JSON{}
+	if len(jsonData) == 0 {
+		return obj, nil
+	}
+	if err := json.Unmarshal(jsonData, obj); err != nil {
+		return nil, err
+	}
+	upgradeVersions(obj.ObjectURL)
+
+	return obj, nil
+}
+
+// writeObjects перезаписывает файл хранилища и обновляет InMemoryCollection,
+// из которой читает GetLongURL.
+func (fs *FileStorage) writeObjects(obj *JSON) error {
+	jsonData, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(fs.filename, jsonData, 0644); err != nil {
+		return err
+	}
+
+	InMemoryCollection.Mutex.Lock()
+	defer InMemoryCollection.Mutex.Unlock()
+	InMemoryCollection.ObjectURL = append([]InMemoryStorage(nil), obj.ObjectURL...)
+	InMemoryCollection.Counter = obj.Counter
+
 	return nil
 }
 
@@ -166,6 +371,7 @@ func ReadJSONFile(filepath string) error {
 	if err != nil {
 		return err
 	}
+	upgradeVersions(InMemoryCollection.ObjectURL)
 
 	return nil
 }
@@ -1,7 +1,19 @@
 package repository
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"shortener/internal"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestSaveAndGetLongURL(t *testing.T) {
@@ -43,3 +55,545 @@ func TestGetLongURLNotFound(t *testing.T) {
 		t.Errorf("Ожидалась пустая строка для ненайденного ID, но получили: %s", retrievedURL)
 	}
 }
+
+func TestUpdateURL(t *testing.T) {
+	storage := &JSON{}
+	storage.SaveURL(&InMemoryStorage{ID: "updID1", LongURL: "https://upd-one.com", ShortURL: "http://localhost/updID1", UserID: "u1"})
+	storage.SaveURL(&InMemoryStorage{ID: "updID2", LongURL: "https://upd-two.com", ShortURL: "http://localhost/updID2", UserID: "u1"})
+
+	item := &InMemoryStorage{ID: "updID1", UserID: "u1", LongURL: "https://upd-fixed.com"}
+	short, err := storage.UpdateURL(item)
+	if err != nil || short != "" {
+		t.Fatalf("Ожидалось успешное изменение, получили %q, %v", short, err)
+	}
+
+	retrievedURL, _, _ := storage.GetLongURL("updID1")
+	if retrievedURL != "https://upd-fixed.com" {
+		t.Errorf("Ожидался длинный URL: %s, но получили: %s", "https://upd-fixed.com", retrievedURL)
+	}
+
+	short, err = storage.UpdateURL(&InMemoryStorage{ID: "updID1", UserID: "u1", LongURL: "https://upd-two.com"})
+	if err != nil || short != "http://localhost/updID2" {
+		t.Errorf("Ожидался конфликт с updID2, получили %q, %v", short, err)
+	}
+
+	if _, err = storage.UpdateURL(&InMemoryStorage{ID: "updID1", UserID: "u2", LongURL: "https://upd-other.com"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Чужая ссылка не должна меняться, получили %v", err)
+	}
+}
+
+func TestGetHistory(t *testing.T) {
+	storage := &JSON{}
+	storage.SaveURL(&InMemoryStorage{ID: "histID", LongURL: "https://hist-one.com", UserID: "u1"})
+	storage.UpdateURL(&InMemoryStorage{ID: "histID", UserID: "u1", LongURL: "https://hist-two.com"})
+
+	history, err := storage.GetHistory("histID", "u1")
+	if err != nil {
+		t.Fatalf("Ошибка при получении истории: %v", err)
+	}
+
+	if len(history) != 2 {
+		t.Fatalf("Ожидалось 2 версии, но получили %d", len(history))
+	}
+	if history[0].LongURL != "https://hist-one.com" || history[1].LongURL != "https://hist-two.com" || history[1].Version != 2 {
+		t.Errorf("Неверная история: %+v", history)
+	}
+	if history[1].ChangedBy != "u1" || history[1].ChangedAt.IsZero() {
+		t.Errorf("Не записан автор или время изменения: %+v", history[1])
+	}
+
+	if _, err = storage.GetHistory("histID", "u2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Чужая история не должна отдаваться, получили %v", err)
+	}
+}
+
+func TestVersionMismatch(t *testing.T) {
+	storage := &JSON{}
+	storage.SaveURL(&InMemoryStorage{ID: "verID", LongURL: "https://ver-one.com", UserID: "u1"})
+
+	item := &InMemoryStorage{ID: "verID", UserID: "u1", LongURL: "https://ver-two.com", Version: 1}
+	if _, err := storage.UpdateURL(item); err != nil {
+		t.Fatalf("Ошибка при изменении URL: %v", err)
+	}
+	if item.Version != 2 {
+		t.Errorf("Ожидалась версия 2, но получили %d", item.Version)
+	}
+
+	stale := &InMemoryStorage{ID: "verID", UserID: "u1", LongURL: "https://ver-three.com", Version: 1}
+	if _, err := storage.UpdateURL(stale); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("Ожидалась ошибка версии, получили %v", err)
+	}
+
+	if err := storage.DeleteByID("verID", "u1", 1); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("Ожидалась ошибка версии при удалении, получили %v", err)
+	}
+	if err := storage.DeleteByID("verID", "u1", 2); err != nil {
+		t.Errorf("Ошибка при удалении URL: %v", err)
+	}
+
+	_, deleted, _ := storage.GetLongURL("verID")
+	if !deleted {
+		t.Error("Ссылка должна быть помечена удалённой")
+	}
+}
+
+func TestSaveURLCollision(t *testing.T) {
+	storage := &JSON{}
+	if _, err := storage.SaveURL(&InMemoryStorage{ID: "collID", LongURL: "https://coll-one.com", UserID: "u1"}); err != nil {
+		t.Fatalf("Ошибка при сохранении URL: %v", err)
+	}
+
+	_, err := storage.SaveURL(&InMemoryStorage{ID: "COLLid", LongURL: "https://coll-two.com", UserID: "u1"})
+	if !errors.Is(err, ErrIDCollision) {
+		t.Errorf("Ожидалась ошибка ErrIDCollision, получили %v", err)
+	}
+
+	retrievedURL, _, _ := storage.GetLongURL("collID")
+	if retrievedURL != "https://coll-one.com" {
+		t.Errorf("Исходная ссылка не должна меняться, получили %s", retrievedURL)
+	}
+}
+
+func TestFileStorageNextSequence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+
+	storage := NewFileStorage(path)
+	for want := uint64(1); want <= counterBlock+1; want++ {
+		if n, err := storage.NextSequence(); err != nil || n != want {
+			t.Fatalf("Ожидалось значение %d, получили %d, %v", want, n, err)
+		}
+	}
+
+	// После перезапуска счётчик продолжается со следующего блока
+	restarted := NewFileStorage(path)
+	if n, err := restarted.NextSequence(); err != nil || n != 2*counterBlock+1 {
+		t.Errorf("Ожидалось значение %d, получили %d, %v", 2*counterBlock+1, n, err)
+	}
+}
+
+func TestExpireURLs(t *testing.T) {
+	storage := &JSON{}
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+	storage.SaveURL(&InMemoryStorage{ID: "expOld", LongURL: "https://exp-old.com", UserID: "exp-user", ExpiresAt: &past})
+	storage.SaveURL(&InMemoryStorage{ID: "expNew", LongURL: "https://exp-new.com", UserID: "exp-user", ExpiresAt: &future})
+
+	// Истёкшая ссылка пропадает из списка ещё до пометки
+	urls, _ := storage.GetUserURLs("exp-user")
+	if len(urls) != 1 || urls[0].LongURL != "https://exp-new.com" {
+		t.Errorf("Ожидалась одна действующая ссылка, получили %+v", urls)
+	}
+
+	expired, err := storage.ExpireURLs(time.Now())
+	if err != nil || expired != 1 {
+		t.Errorf("Ожидалась одна истёкшая ссылка, получили %d, %v", expired, err)
+	}
+
+	// Истёкшая ссылка помечается отдельно от удалённых
+	item, err := storage.GetURL("expOld")
+	if err != nil || !item.Lapsed || item.Flag {
+		t.Errorf("Ожидалась пометка истёкшей без удаления, получили %+v, %v", item, err)
+	}
+	if stats, _ := storage.Stats(); stats.Deleted != 0 || stats.Expired != 1 {
+		t.Errorf("Истёкшая ссылка не должна считаться удалённой, получили %+v", stats)
+	}
+}
+
+func TestConsumeClickConcurrent(t *testing.T) {
+	storage := &JSON{}
+	limit := int64(5)
+	storage.SaveURL(&InMemoryStorage{ID: "clickID", LongURL: "https://click-limit.com", UserID: "u1", ClicksLeft: &limit})
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	succeeded := 0
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := storage.ConsumeClick("CLICKid"); err == nil {
+				mutex.Lock()
+				succeeded++
+				mutex.Unlock()
+			} else if !errors.Is(err, ErrExhausted) {
+				t.Errorf("Неожиданная ошибка: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if succeeded != int(limit) {
+		t.Errorf("Ожидалось %d переходов, получили %d", limit, succeeded)
+	}
+
+	item, _ := storage.GetURL("clickID")
+	if item.ClicksLeft == nil || *item.ClicksLeft != 0 {
+		t.Errorf("Ожидался нулевой остаток переходов, получили %v", item.ClicksLeft)
+	}
+
+	// Удалённая ссылка не списывает переходы, даже если они остались
+	left := int64(3)
+	storage.SaveURL(&InMemoryStorage{ID: "deletedClickID", LongURL: "https://click-deleted.com", UserID: "u1", ClicksLeft: &left})
+	if err := storage.DeleteByID("deletedClickID", "u1", 0); err != nil {
+		t.Fatalf("Ошибка удаления: %v", err)
+	}
+	if err := storage.ConsumeClick("deletedClickID"); !errors.Is(err, ErrExhausted) {
+		t.Errorf("Ожидалась ErrExhausted для удалённой ссылки, получили %v", err)
+	}
+}
+
+func TestFileStorageSetRules(t *testing.T) {
+	storage := NewFileStorage(filepath.Join(t.TempDir(), "urls.json"))
+	item := &InMemoryStorage{ID: "rulesID", LongURL: "https://rules.example.com", UserID: "owner"}
+	if _, err := storage.SaveURL(item); err != nil {
+		t.Fatalf("Ошибка при сохранении URL: %v", err)
+	}
+
+	rules := []Rule{{Platform: "ios", URL: "https://apps.apple.com/app"}}
+	if _, err := storage.SetRules("rulesID", "other", 0, rules); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Ожидалась ErrNotFound для чужой ссылки, получили %v", err)
+	}
+	version, err := storage.SetRules("RULESID", "owner", 1, rules)
+	if err != nil || version != 2 {
+		t.Fatalf("Ошибка при сохранении правил: версия %d, %v", version, err)
+	}
+	if _, err := storage.SetRules("rulesID", "owner", 1, nil); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("Ожидалась ErrVersionMismatch для устаревшей версии, получили %v", err)
+	}
+
+	got, err := storage.GetURL("rulesID")
+	if err != nil || len(got.Rules) != 1 || got.Rules[0].URL != rules[0].URL {
+		t.Errorf("Ожидались сохранённые правила, получили %+v, %v", got, err)
+	}
+}
+
+func TestFileStorageSetFallbacks(t *testing.T) {
+	storage := NewFileStorage(filepath.Join(t.TempDir(), "urls.json"))
+	item := &InMemoryStorage{ID: "mirrorID", LongURL: "https://mirror.example.com", UserID: "owner"}
+	if _, err := storage.SaveURL(item); err != nil {
+		t.Fatalf("Ошибка при сохранении URL: %v", err)
+	}
+
+	fallbacks := FallbackURLs([]string{"https://backup.example.com"})
+	version, err := storage.SetFallbacks("mirrorID", "owner", 1, fallbacks)
+	if err != nil || version != 2 {
+		t.Fatalf("Ошибка при сохранении запасных адресов: версия %d, %v", version, err)
+	}
+	if _, err := storage.SetFallbacks("mirrorID", "owner", 1, nil); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("Ожидалась ErrVersionMismatch для устаревшей версии, получили %v", err)
+	}
+
+	got, err := storage.GetURL("mirrorID")
+	if err != nil || got.Version != 2 || len(got.Fallbacks) != 1 {
+		t.Errorf("Ожидались запасные адреса и версия 2, получили %+v, %v", got, err)
+	}
+}
+
+func TestCountClicks(t *testing.T) {
+	storage := &JSON{}
+	item := &InMemoryStorage{ID: "variantID", LongURL: "https://variant.example.com", UserID: "owner"}
+	if _, err := storage.SaveURL(item); err != nil {
+		t.Fatalf("Ошибка при сохранении URL: %v", err)
+	}
+
+	destinations := []Destination{{URL: "https://a.example.com", Weight: 1, Clicks: 5}, {URL: "https://b.example.com", Weight: 1}}
+	version, err := storage.SetDestinations("variantID", "owner", 1, destinations)
+	if err != nil || version != 2 {
+		t.Fatalf("Ошибка при сохранении вариантов: версия %d, %v", version, err)
+	}
+	if _, err := storage.SetDestinations("variantID", "owner", 1, destinations); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("Ожидалась ErrVersionMismatch для устаревшей версии, получили %v", err)
+	}
+	clicks := []Click{
+		{LinkID: "variantID", Variant: 1, Destination: "https://b.example.com"},
+		{LinkID: "VARIANTID", Variant: 1, Destination: "https://b.example.com"},
+		{LinkID: "variantID", Variant: -1},
+		{LinkID: "variantID", Variant: 1, Destination: "https://b.example.com"},
+		// Индекс за пределами списка пропускается
+		{LinkID: "variantID", Variant: 5, Destination: "https://b.example.com"},
+		// Переход к варианту, который успели заменить, идёт только в счётчик ссылки
+		{LinkID: "variantID", Variant: 0, Destination: "https://old.example.com"},
+	}
+	if err := storage.CountClicks(clickCounts(clicks)); err != nil {
+		t.Fatalf("Ошибка учёта вариантов: %v", err)
+	}
+
+	got, _ := storage.GetURL("variantID")
+	if got.Destinations[0].Clicks != 0 || got.Destinations[1].Clicks != 3 {
+		t.Errorf("Ожидались счётчики 0 и 3, получили %+v", got.Destinations)
+	}
+	if got.Clicks != 6 {
+		t.Errorf("Ожидалось 6 переходов по ссылке, получили %d", got.Clicks)
+	}
+}
+
+func TestClickHandlerFlushesOnClose(t *testing.T) {
+	storage := NewFileStorage(filepath.Join(t.TempDir(), "urls.json"))
+	clickChan := make(chan Click, 10)
+	done := make(chan struct{})
+	go func() {
+		ClickHandler(storage, clickChan, time.Hour)
+		close(done)
+	}()
+
+	for i := 0; i < 3; i++ {
+		clickChan <- Click{LinkID: "flushID", Time: time.Now(), Variant: -1}
+	}
+	close(clickChan)
+	<-done
+
+	data, err := os.ReadFile(storage.clicksFile())
+	if err != nil {
+		t.Fatalf("Ошибка чтения файла переходов: %v", err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 3 {
+		t.Errorf("Ожидалось 3 перехода в файле, получили %d", lines)
+	}
+}
+
+func TestCountStats(t *testing.T) {
+	records := []InMemoryStorage{
+		{ID: "a", UserID: "u1"},
+		{ID: "b", UserID: "u1"},
+		{ID: "c", UserID: "u2", Flag: true},
+		{ID: "d", UserID: "u3"},
+	}
+
+	stats := countStats(records)
+	if stats != (ServiceStats{URLs: 4, Users: 2, Deleted: 1}) {
+		t.Errorf("Неожиданная сводка: %+v", stats)
+	}
+}
+
+func TestFullHealthDue(t *testing.T) {
+	start := time.Now()
+	cases := []struct {
+		elapsed, interval, tick time.Duration
+		want                    bool
+	}{
+		{time.Minute, time.Hour, time.Minute, false},
+		{59*time.Minute + 59*time.Second, time.Hour, time.Minute, true},
+		{time.Hour, time.Hour, time.Hour, true},
+		{time.Hour, 0, time.Minute, false},
+	}
+	for _, c := range cases {
+		if got := fullHealthDue(start.Add(c.elapsed), start, c.interval, c.tick); got != c.want {
+			t.Errorf("Через %v при интервале %v и шаге %v ожидалось %v", c.elapsed, c.interval, c.tick, c.want)
+		}
+	}
+}
+
+func TestEnrichHandler(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<title>Страница</title><meta name="description" content="Описание">`))
+	}))
+	defer srv.Close()
+
+	storage := NewFileStorage(filepath.Join(t.TempDir(), "urls.json"))
+	for _, item := range []*InMemoryStorage{
+		{ID: "fresh", LongURL: srv.URL + "/a", UserID: "u1"},
+		{ID: "moved", LongURL: srv.URL + "/b", UserID: "u1"},
+	} {
+		if _, err := storage.SaveURL(item); err != nil {
+			t.Fatalf("Ошибка сохранения: %v", err)
+		}
+	}
+
+	enrichChan := make(chan EnrichRequest, 2)
+	enrichChan <- EnrichRequest{ID: "fresh", LongURL: srv.URL + "/a"}
+	// Адрес сменился, пока страница загружалась: сведения к ссылке не относятся
+	enrichChan <- EnrichRequest{ID: "moved", LongURL: srv.URL + "/old"}
+	close(enrichChan)
+
+	fetcher := &internal.HTTPMetadataFetcher{Client: srv.Client(), MaxBytes: 1024}
+	EnrichHandler(storage, enrichChan, fetcher, 2, time.Second)
+
+	item, err := storage.GetURL("fresh")
+	if err != nil {
+		t.Fatalf("Ошибка получения: %v", err)
+	}
+	if item.Metadata == nil || item.Metadata.Title != "Страница" || item.Metadata.Description != "Описание" {
+		t.Errorf("Неожиданные сведения: %+v", item.Metadata)
+	}
+
+	item, err = storage.GetURL("moved")
+	if err != nil {
+		t.Fatalf("Ошибка получения: %v", err)
+	}
+	if item.Metadata != nil {
+		t.Errorf("Сведения о прежнем адресе записаны: %+v", item.Metadata)
+	}
+}
+
+// healthWrites считает записи проверок в хранилище.
+type healthWrites struct {
+	Storage
+	calls atomic.Int64
+}
+
+func (h *healthWrites) SetHealth(results []HealthResult) error {
+	h.calls.Add(1)
+	return h.Storage.SetHealth(results)
+}
+
+// stubChecker отвечает кодом по адресу и следит, чтобы к одному сайту не было
+// одновременных запросов.
+type stubChecker struct {
+	mu       sync.Mutex
+	inFlight map[string]bool
+	overlap  atomic.Bool
+	calls    atomic.Int64
+	statuses map[string]int
+}
+
+func (c *stubChecker) Check(ctx context.Context, rawURL string) (int, error) {
+	c.calls.Add(1)
+	u, _ := url.Parse(rawURL)
+
+	c.mu.Lock()
+	if c.inFlight[u.Host] {
+		c.overlap.Store(true)
+	}
+	c.inFlight[u.Host] = true
+	c.mu.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	c.mu.Lock()
+	c.inFlight[u.Host] = false
+	c.mu.Unlock()
+
+	status, ok := c.statuses[rawURL]
+	if !ok {
+		return 0, errors.New("соединение отклонено")
+	}
+	return status, nil
+}
+
+func TestCheckHealth(t *testing.T) {
+	storage := NewFileStorage(filepath.Join(t.TempDir(), "urls.json"))
+	past := time.Now().Add(-time.Hour)
+	for _, item := range []*InMemoryStorage{
+		{ID: "ok", LongURL: "https://a.example/1", UserID: "u1"},
+		{ID: "gone", LongURL: "https://a.example/2", UserID: "u1"},
+		{ID: "down", LongURL: "https://b.example/", UserID: "u1"},
+		{ID: "old", LongURL: "https://c.example/", UserID: "u1", ExpiresAt: &past},
+		{ID: "backup", LongURL: "https://d.example/", UserID: "u1", Fallbacks: FallbackURLs([]string{"https://a.example/1"})},
+		{ID: "split", LongURL: "https://a.example/1", UserID: "u1",
+			Rules:        []Rule{{Platform: "ios", URL: "https://e.example/app"}},
+			Destinations: []Destination{{URL: "https://a.example/1", Weight: 1}, {URL: "https://a.example/2", Weight: 1}}},
+	} {
+		if _, err := storage.SaveURL(item); err != nil {
+			t.Fatalf("Ошибка сохранения: %v", err)
+		}
+	}
+
+	checker := &stubChecker{
+		inFlight: make(map[string]bool),
+		statuses: map[string]int{"https://a.example/1": 200, "https://a.example/2": 404},
+	}
+	writes := &healthWrites{Storage: storage}
+	err := CheckHealth(writes, checker, time.Now(), HealthOptions{Workers: 4, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("Ошибка проверки: %v", err)
+	}
+	if n := writes.calls.Load(); n != 1 {
+		t.Errorf("Ожидалась одна запись проверок за раунд, получили %d", n)
+	}
+
+	if checker.overlap.Load() {
+		t.Error("Запросы к одному сайту шли одновременно")
+	}
+	if calls := checker.calls.Load(); calls != 5 {
+		t.Errorf("Ожидалось 5 проверок без истёкшей ссылки и повторов, получили %d", calls)
+	}
+
+	for id, broken := range map[string]bool{"ok": false, "gone": true, "down": true, "backup": true} {
+		item, err := storage.GetURL(id)
+		if err != nil {
+			t.Fatalf("Ошибка получения %s: %v", id, err)
+		}
+		if item.Health == nil || item.Health.Broken() != broken {
+			t.Errorf("Ссылка %s: неожиданная проверка %+v", id, item.Health)
+		}
+	}
+
+	// Запасной адрес совпадает с адресом другой ссылки и получает ту же проверку
+	item, err := storage.GetURL("backup")
+	if err != nil {
+		t.Fatalf("Ошибка получения: %v", err)
+	}
+	if h := item.Fallbacks[0].Health; h == nil || h.Broken() {
+		t.Errorf("Неожиданная проверка запасного адреса: %+v", h)
+	}
+
+	// Адреса правил и вариантов A/B-теста проверяются вместе с основным
+	item, err = storage.GetURL("split")
+	if err != nil {
+		t.Fatalf("Ошибка получения: %v", err)
+	}
+	if h := item.Rules[0].Health; h == nil || !h.Broken() {
+		t.Errorf("Неожиданная проверка адреса правила: %+v", h)
+	}
+	if h := item.Destinations[0].Health; h == nil || h.Broken() {
+		t.Errorf("Неожиданная проверка первого варианта: %+v", h)
+	}
+	if h := item.Destinations[1].Health; h == nil || !h.Broken() {
+		t.Errorf("Неожиданная проверка второго варианта: %+v", h)
+	}
+	if !NewRez(item).BrokenTarget() {
+		t.Error("Ссылка с нерабочим вариантом должна считаться сломанной")
+	}
+
+	// Пробная проверка обходит только ссылки с запасными адресами
+	checker.calls.Store(0)
+	opts := HealthOptions{Workers: 4, Timeout: time.Second, OnlyFallbacks: true}
+	if err := CheckHealth(storage, checker, time.Now(), opts); err != nil {
+		t.Fatalf("Ошибка проверки: %v", err)
+	}
+	if calls := checker.calls.Load(); calls != 2 {
+		t.Errorf("Ожидалось 2 проверки ссылки с запасным адресом, получили %d", calls)
+	}
+}
+
+func TestLegacyRecordVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "urls.json")
+	legacy := `{"ObjectURL":[{"id":"oldID","longURL":"https://legacy.com","short_url":"http://localhost/oldID","userID":"u1","flag":false}]}`
+	if err := os.WriteFile(path, []byte(legacy), 0644); err != nil {
+		t.Fatalf("Ошибка записи файла: %v", err)
+	}
+	if err := ReadJSONFile(path); err != nil {
+		t.Fatalf("Ошибка чтения файла: %v", err)
+	}
+
+	storage := NewFileStorage(path)
+	item, err := storage.GetURL("oldID")
+	if err != nil {
+		t.Fatalf("Ошибка получения: %v", err)
+	}
+	if item.Version != 1 {
+		t.Fatalf("Ссылке без версии должна достаться версия 1, получили %d", item.Version)
+	}
+
+	// ETag старой ссылки можно вернуть в If-Match
+	update := &InMemoryStorage{ID: "oldID", UserID: "u1", LongURL: "https://legacy-new.com", Version: item.Version}
+	if _, err := storage.UpdateURL(update); err != nil {
+		t.Errorf("Ошибка изменения по версии 1: %v", err)
+	}
+}
+
+func TestDeleteURLCaseInsensitive(t *testing.T) {
+	storage := NewFileStorage(filepath.Join(t.TempDir(), "urls.json"))
+	if _, err := storage.SaveURL(&InMemoryStorage{ID: "MyAlias", LongURL: "https://alias-case.com", UserID: "u1"}); err != nil {
+		t.Fatalf("Ошибка сохранения: %v", err)
+	}
+
+	if err := storage.DeleteURL([]string{"myalias"}, "u1"); err != nil {
+		t.Fatalf("Ошибка удаления: %v", err)
+	}
+	if _, deleted, _ := storage.GetLongURL("MyAlias"); !deleted {
+		t.Error("Алиас должен удаляться по идентификатору в другом регистре")
+	}
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"shortener/internal/app/handlers/service/repository"
+	"shortener/internal/app/middleware"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	maxDestinations = 10
+	maxWeight       = 1000
+	// variantCookieAge — сколько посетитель видит один и тот же вариант.
+	variantCookieAge = 30 * 24 * time.Hour
+)
+
+// validateDestinations проверяет варианты A/B-теста. Пустой список отключает тест.
+// Счётчики и проверки адресов ведёт сервис, поэтому присланные сбрасываются.
+func validateDestinations(destinations []repository.Destination) error {
+	if len(destinations) == 1 || len(destinations) > maxDestinations {
+		return fmt.Errorf("вариантов должно быть от 2 до %d", maxDestinations)
+	}
+
+	for i := range destinations {
+		d := &destinations[i]
+		if d.Weight < 1 || d.Weight > maxWeight {
+			return fmt.Errorf("вариант %d: вес должен быть от 1 до %d", i+1, maxWeight)
+		}
+
+		longURL, err := parseURL(d.URL)
+		if err != nil {
+			return fmt.Errorf("вариант %d: некорректный адрес: %w", i+1, err)
+		}
+		d.URL = longURL
+		d.Clicks = 0
+		d.Health = nil
+	}
+
+	return nil
+}
+
+// pickDestination выбирает адрес перехода: подходящее правило, затем вариант
+// A/B-теста, затем адрес ссылки. Индекс варианта равен -1, если тест не участвовал.
+func pickDestination(w http.ResponseWriter, r *http.Request, item *repository.InMemoryStorage, geoHeader string) (string, int) {
+	if len(item.Rules) > 0 {
+		// Адрес зависит от заголовков запроса, и кеши должны различать ответы по ним
+		w.Header().Add("Vary", ruleVary(geoHeader))
+	}
+	if longURL, ok := matchRules(r, item.Rules, geoHeader); ok {
+		return longURL, -1
+	}
+	if len(item.Destinations) == 0 {
+		return item.LongURL, -1
+	}
+
+	variant := stickyVariant(w, r, item)
+	return item.Destinations[variant].URL, variant
+}
+
+// stickyVariant возвращает вариант из cookie посетителя, а новому посетителю
+// выбирает его по весу и запоминает.
+func stickyVariant(w http.ResponseWriter, r *http.Request, item *repository.InMemoryStorage) int {
+	name := "variant_" + strings.ToLower(item.ID)
+	if cookie, err := r.Cookie(name); err == nil {
+		if v, err := strconv.Atoi(cookie.Value); err == nil && v >= 0 && v < len(item.Destinations) {
+			return v
+		}
+	}
+
+	variant := weightedChoice(item.Destinations, rand.Intn)
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    strconv.Itoa(variant),
+		Path:     "/",
+		MaxAge:   int(variantCookieAge.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return variant
+}
+
+// weightedChoice выбирает индекс варианта с вероятностью, пропорциональной весу.
+func weightedChoice(destinations []repository.Destination, intn func(int) int) int {
+	total := 0
+	for _, d := range destinations {
+		total += d.Weight
+	}
+	if total <= 0 {
+		return 0
+	}
+
+	n := intn(total)
+	for i, d := range destinations {
+		if n < d.Weight {
+			return i
+		}
+		n -= d.Weight
+	}
+	return len(destinations) - 1
+}
+
+// PutURLDestinations заменяет варианты A/B-теста ссылки пользователя.
+func PutURLDestinations(w http.ResponseWriter, r *http.Request, storage repository.Storage) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		fmt.Println("userID not found in context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	version, err := parseIfMatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var destinations []repository.Destination
+	if err := json.NewDecoder(r.Body).Decode(&destinations); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateDestinations(destinations); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	version, err = storage.SetDestinations(chi.URLParam(r, "id"), userID, version, destinations)
+	if writeLinkError(w, err) {
+		return
+	}
+
+	if destinations == nil {
+		destinations = []repository.Destination{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", formatETag(version))
+	json.NewEncoder(w).Encode(destinations)
+}
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"shortener/internal/app/handlers/service/repository"
+	"shortener/internal/app/middleware"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// defaultStatsRange — период статистики, если from не указан.
+	defaultStatsRange = 7 * 24 * time.Hour
+	// maxStatsBuckets ограничивает длину ряда, чтобы час за несколько лет не собирался в один ответ.
+	maxStatsBuckets = 2000
+)
+
+// Bucket — число переходов за час или день, начиная с Time.
+type Bucket struct {
+	Time   time.Time `json:"time"`
+	Clicks int       `json:"clicks"`
+}
+
+// LinkStats — статистика переходов по ссылке за период [From, To). AllTime — счётчик
+// ссылки за всё время. Переходы, события которых потерялись при переполнении
+// канала, не попадают ни в один из счётчиков.
+type LinkStats struct {
+	From      time.Time      `json:"from"`
+	To        time.Time      `json:"to"`
+	Bucket    string         `json:"bucket"`
+	AllTime   int64          `json:"all_time"`
+	Total     int            `json:"total"`
+	Unique    int            `json:"unique"`
+	Series    []Bucket       `json:"series"`
+	Referrers map[string]int `json:"referrers"`
+	Devices   map[string]int `json:"devices"`
+}
+
+// parseStatsRange читает период и размер корзины из параметров from, to и bucket.
+func parseStatsRange(q url.Values, now time.Time) (from, to time.Time, step time.Duration, err error) {
+	to = now.UTC()
+	if v := q.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, 0, fmt.Errorf("некорректный to: %w", err)
+		}
+	}
+	from = to.Add(-defaultStatsRange)
+	if v := q.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return from, to, 0, fmt.Errorf("некорректный from: %w", err)
+		}
+	}
+	from, to = from.UTC(), to.UTC()
+	if !from.Before(to) {
+		return from, to, 0, errors.New("from должен быть раньше to")
+	}
+
+	switch q.Get("bucket") {
+	case "", "day":
+		step = 24 * time.Hour
+	case "hour":
+		step = time.Hour
+	default:
+		return from, to, 0, fmt.Errorf("неизвестный bucket: %q", q.Get("bucket"))
+	}
+
+	if to.Sub(from.Truncate(step))/step >= maxStatsBuckets {
+		return from, to, 0, fmt.Errorf("слишком длинный период: не больше %d корзин", maxStatsBuckets)
+	}
+	return from, to, step, nil
+}
+
+// buildStats сводит переходы в статистику. Корзины выровнены по UTC и идут без пропусков.
+func buildStats(clicks []repository.Click, from, to time.Time, step time.Duration) LinkStats {
+	stats := LinkStats{
+		From:      from,
+		To:        to,
+		Bucket:    "day",
+		Total:     len(clicks),
+		Referrers: make(map[string]int),
+		Devices:   make(map[string]int),
+	}
+	if step == time.Hour {
+		stats.Bucket = "hour"
+	}
+
+	start := from.Truncate(step)
+	for t := start; t.Before(to); t = t.Add(step) {
+		stats.Series = append(stats.Series, Bucket{Time: t})
+	}
+
+	visitors := make(map[string]bool)
+	for _, c := range clicks {
+		if i := int(c.Time.Sub(start) / step); i >= 0 && i < len(stats.Series) {
+			stats.Series[i].Clicks++
+		}
+		// Посетитель различается по обезличенному адресу и User-Agent
+		visitors[c.IP+"|"+c.UserAgent] = true
+		stats.Referrers[referrerDomain(c.Referrer)]++
+		stats.Devices[deviceType(c.UserAgent)]++
+	}
+	stats.Unique = len(visitors)
+
+	return stats
+}
+
+// referrerDomain возвращает домен источника перехода без "www.", а для прямых переходов — "direct".
+func referrerDomain(referrer string) string {
+	u, err := url.Parse(referrer)
+	if referrer == "" || err != nil || u.Hostname() == "" {
+		return "direct"
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
+
+// deviceType относит User-Agent к типу устройства.
+func deviceType(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case ua == "":
+		return "unknown"
+	case strings.Contains(ua, "bot") || strings.Contains(ua, "crawler") || strings.Contains(ua, "spider"):
+		return "bot"
+	case strings.Contains(ua, "ipad") || strings.Contains(ua, "tablet") || (strings.Contains(ua, "android") && !strings.Contains(ua, "mobile")):
+		return "tablet"
+	case matchPlatform("mobile", ua):
+		return "mobile"
+	}
+	return "desktop"
+}
+
+// GetURLStats возвращает статистику переходов. Доступна только владельцу ссылки.
+func GetURLStats(w http.ResponseWriter, r *http.Request, storage repository.Storage) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(string)
+	if !ok {
+		fmt.Println("userID not found in context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	from, to, step, err := parseStatsRange(r.URL.Query(), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Чужая ссылка неотличима от несуществующей
+	item, err := storage.GetURL(chi.URLParam(r, "id"))
+	if errors.Is(err, repository.ErrNotFound) || (err == nil && item.UserID != userID) {
+		http.Error(w, "URL не найден", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Ошибка получения URL", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	clicks, err := storage.GetClicks(item.ID, from, to)
+	if err != nil {
+		log.Println("Ошибка получения переходов", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	stats := buildStats(clicks, from, to, step)
+	stats.AllTime = item.Clicks
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
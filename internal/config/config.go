@@ -1,9 +1,19 @@
 package config
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"shortener/internal"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
@@ -12,6 +22,78 @@ type Config struct {
 	BaseURL     string
 	DataBaseDSN string
 	TypeStorage string
+	IDGenerator string
+	IDLength    int
+
+	IDHashKey     string
+	IDHashPerUser bool
+
+	// DenyList — запрещённые в идентификаторах слова; пустой список означает список по умолчанию.
+	DenyList []string
+	// ReservedPaths заполняется при запуске сервера первыми сегментами его маршрутов.
+	ReservedPaths []string
+
+	// ExpireInterval — период, с которым истёкшие ссылки помечаются удалёнными.
+	ExpireInterval time.Duration
+
+	// RedirectCode — код перенаправления для ссылок, у которых он не выбран при создании.
+	RedirectCode int
+
+	// GeoHeader — заголовок с кодом страны клиента, который выставляет балансировщик.
+	GeoHeader string
+
+	// PendingURL — куда вести посетителя, пока окно ссылки не открылось и у неё нет своего адреса.
+	PendingURL string
+	// PendingMessage — ответ до открытия окна, если адреса для перехода нет.
+	PendingMessage string
+
+	// ClickBuffer — ёмкость канала событий переходов; при переполнении события теряются.
+	ClickBuffer int
+	// ClickFlushInterval — как часто накопленные переходы записываются в хранилище.
+	ClickFlushInterval time.Duration
+
+	// TrustedSubnet — сеть, из которой доступна внутренняя статистика; nil закрывает её для всех.
+	TrustedSubnet *net.IPNet
+	// TrustedProxies — обратные прокси, чьему X-Real-IP можно верить. Клиенту из
+	// TrustedSubnet заголовок тоже разрешён, остальным он игнорируется.
+	TrustedProxies []*net.IPNet
+
+	// QRSize — ширина QR-кода в пикселях, QRLevel — уровень коррекции L, M, Q или H,
+	// QRMargin — белое поле в модулях. Всё можно переопределить в запросе.
+	QRSize   int
+	QRLevel  string
+	QRMargin int
+
+	// EnrichWorkers — сколько страниц назначения загружается одновременно,
+	// EnrichTimeout и EnrichMaxBytes ограничивают время и объём одной загрузки.
+	EnrichWorkers  int
+	EnrichTimeout  time.Duration
+	EnrichMaxBytes int64
+
+	// HealthInterval — как часто проверяются адреса назначения; 0 отключает проверку.
+	HealthInterval time.Duration
+	// HealthWorkers — сколько сайтов проверяется одновременно, HealthHostDelay —
+	// пауза между запросами к одному сайту, HealthTimeout ограничивает одну проверку.
+	HealthWorkers   int
+	HealthHostDelay time.Duration
+	HealthTimeout   time.Duration
+	// FallbackProbeInterval — как часто проверяются ссылки с запасными адресами; 0 отключает проверку.
+	FallbackProbeInterval time.Duration
+}
+
+// DefaultRedirectCode сохраняет прежнее поведение сервиса.
+const DefaultRedirectCode = http.StatusTemporaryRedirect
+
+// DefaultPendingMessage — ответ до открытия окна ссылки, если свой не задан.
+const DefaultPendingMessage = "Ссылка ещё не активна"
+
+// ValidRedirectCode сообщает, подходит ли код для перенаправления по ссылке.
+func ValidRedirectCode(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
 }
 
 type Builder struct {
@@ -49,6 +131,94 @@ func (b *Builder) TypeStorage(TypeStorage string) *Builder {
 	return b
 }
 
+func (b *Builder) IDGenerator(kind string) *Builder {
+	b.config.IDGenerator = kind
+	return b
+}
+
+func (b *Builder) IDLength(length int) *Builder {
+	b.config.IDLength = length
+	return b
+}
+
+func (b *Builder) IDHash(key string, perUser bool) *Builder {
+	b.config.IDHashKey = key
+	b.config.IDHashPerUser = perUser
+	return b
+}
+
+func (b *Builder) DenyList(words []string) *Builder {
+	b.config.DenyList = words
+	return b
+}
+
+func (b *Builder) ExpireInterval(interval time.Duration) *Builder {
+	b.config.ExpireInterval = interval
+	return b
+}
+
+func (b *Builder) RedirectCode(code int) *Builder {
+	b.config.RedirectCode = code
+	return b
+}
+
+func (b *Builder) GeoHeader(header string) *Builder {
+	b.config.GeoHeader = header
+	return b
+}
+
+func (b *Builder) Pending(url, message string) *Builder {
+	if message == "" {
+		message = DefaultPendingMessage
+	}
+	b.config.PendingURL = url
+	b.config.PendingMessage = message
+	return b
+}
+
+func (b *Builder) Clicks(buffer int, flushInterval time.Duration) *Builder {
+	b.config.ClickBuffer = buffer
+	b.config.ClickFlushInterval = flushInterval
+	return b
+}
+
+func (b *Builder) TrustedSubnet(subnet *net.IPNet) *Builder {
+	b.config.TrustedSubnet = subnet
+	return b
+}
+
+func (b *Builder) TrustedProxies(proxies []*net.IPNet) *Builder {
+	b.config.TrustedProxies = proxies
+	return b
+}
+
+func (b *Builder) QR(size int, level string, margin int) *Builder {
+	b.config.QRSize = size
+	b.config.QRLevel = level
+	b.config.QRMargin = margin
+	return b
+}
+
+func (b *Builder) Enrich(workers int, timeout time.Duration, maxBytes int64) *Builder {
+	b.config.EnrichWorkers = workers
+	b.config.EnrichTimeout = timeout
+	b.config.EnrichMaxBytes = maxBytes
+	return b
+}
+
+func (b *Builder) Health(interval time.Duration, workers int, hostDelay, timeout time.Duration) *Builder {
+	b.config.HealthInterval = interval
+	b.config.HealthWorkers = workers
+	b.config.HealthHostDelay = hostDelay
+	b.config.HealthTimeout = timeout
+	return b
+}
+
+func (b *Builder) FallbackProbe(interval time.Duration) *Builder {
+	b.config.FallbackProbeInterval = interval
+	return b
+}
+
 func (b *Builder) Build() *Config {
 	return b.config
 }
@@ -63,6 +233,55 @@ func getEnvOrFlag(envKey string, flagValue string, defaultValue string) string {
 	return envVal
 }
 
+// readConfigFile читает JSON-файл настроек. Ключи — имена переменных окружения
+// в нижнем регистре, например "server_address" или "trusted_subnet".
+func readConfigFile(path string) (map[string]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось прочитать файл конфигурации: %w", err)
+	}
+
+	// Числа остаются в записи из файла: float64 превратил бы 1000000 в 1e+06
+	var raw map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("некорректный файл конфигурации: %w", err)
+	}
+	if decoder.More() {
+		return nil, errors.New("некорректный файл конфигурации: лишние данные после объекта")
+	}
+
+	settings := make(map[string]string, len(raw))
+	for key, value := range raw {
+		settings[strings.ToLower(key)] = fmt.Sprint(value)
+	}
+	return settings, nil
+}
+
+func readDenyList(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось прочитать список запрещённых слов: %w", err)
+	}
+
+	var words []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if word := strings.TrimSpace(line); word != "" && !strings.HasPrefix(word, "#") {
+			words = append(words, word)
+		}
+	}
+	return words, nil
+}
+
 func InitConfig() (*Config, error) {
 	var (
 		addrFlag     string
@@ -70,20 +289,213 @@ func InitConfig() (*Config, error) {
 		fileFlag     string
 		dataBaseFlag string
 		typeStor     string
+		idGenFlag    string
+		idLenFlag    string
+		hashKeyFlag  string
+		perUserFlag  string
+		denyListFlag string
+		expireFlag   string
+		redirectFlag string
+		geoFlag      string
+		pendingURL   string
+		pendingText  string
+		clickBufFlag string
+		clickFlush   string
+		configFlag   string
+		subnetFlag   string
+		proxiesFlag  string
+		qrSizeFlag   string
+		qrLevelFlag  string
+		qrMarginFlag string
+		enrichFlag   string
+		enrichTime   string
+		enrichBytes  string
+		healthFlag   string
+		healthWork   string
+		healthDelay  string
+		healthTime   string
+		probeFlag    string
 	)
 
 	flag.StringVar(&addrFlag, "a", "", "HTTP-сервера")
 	flag.StringVar(&baseURLFlag, "b", "", "Базовый адрес результирующего сокращённого URL")
 	flag.StringVar(&fileFlag, "f", "", "Путь до файла с сокращёнными URL")
 	flag.StringVar(&dataBaseFlag, "d", "", "Подключение к базе данных")
+	flag.StringVar(&idGenFlag, "g", "", "Генератор идентификаторов: base36, unambiguous, digits, hash или counter")
+	flag.StringVar(&idLenFlag, "l", "", "Длина идентификатора короткой ссылки (для counter — минимальная)")
+	flag.StringVar(&hashKeyFlag, "k", "", "Ключ генераторов hash и counter")
+	flag.StringVar(&perUserFlag, "hash-per-user", "", "Подмешивать пользователя к хэшу генератора hash")
+	flag.StringVar(&denyListFlag, "deny-list", "", "Файл со словами, запрещёнными в идентификаторах, по одному в строке")
+	flag.StringVar(&expireFlag, "expire-interval", "", "Период проверки истёкших ссылок")
+	flag.StringVar(&redirectFlag, "redirect-code", "", "Код перенаправления по умолчанию: 301, 302, 307 или 308")
+	flag.StringVar(&geoFlag, "geo-header", "", "Заголовок с кодом страны клиента для правил перенаправления")
+	flag.StringVar(&pendingURL, "pending-url", "", "Адрес для ссылок, окно которых ещё не открылось")
+	flag.StringVar(&pendingText, "pending-message", "", "Ответ для ссылок, окно которых ещё не открылось")
+	flag.StringVar(&clickBufFlag, "click-buffer", "", "Ёмкость очереди событий переходов")
+	flag.StringVar(&clickFlush, "click-flush", "", "Период записи событий переходов в хранилище")
+	flag.StringVar(&configFlag, "c", "", "Файл конфигурации в формате JSON")
+	flag.StringVar(&subnetFlag, "t", "", "Доверенная подсеть для внутренней статистики в нотации CIDR")
+	flag.StringVar(&proxiesFlag, "trusted-proxies", "", "Подсети обратных прокси через запятую, которым можно верить в X-Real-IP")
+	flag.StringVar(&qrSizeFlag, "qr-size", "", "Ширина QR-кода по умолчанию в пикселях")
+	flag.StringVar(&qrLevelFlag, "qr-level", "", "Уровень коррекции QR-кода по умолчанию: L, M, Q или H")
+	flag.StringVar(&qrMarginFlag, "qr-margin", "", "Белое поле QR-кода по умолчанию в модулях")
+	flag.StringVar(&enrichFlag, "enrich-workers", "", "Сколько страниц назначения загружать одновременно")
+	flag.StringVar(&enrichTime, "enrich-timeout", "", "Время на загрузку сведений о странице назначения")
+	flag.StringVar(&enrichBytes, "enrich-max-bytes", "", "Сколько байт страницы назначения читать в поисках сведений")
+	flag.StringVar(&healthFlag, "health-interval", "", "Период проверки адресов назначения; 0 отключает проверку")
+	flag.StringVar(&healthWork, "health-workers", "", "Сколько сайтов проверять одновременно")
+	flag.StringVar(&healthDelay, "health-host-delay", "", "Пауза между проверками адресов одного сайта")
+	flag.StringVar(&healthTime, "health-timeout", "", "Время на проверку одного адреса назначения")
+	flag.StringVar(&probeFlag, "fallback-probe", "", "Период проверки ссылок с запасными адресами; 0 отключает проверку")
 	flag.Parse()
 
-	serverAddress := getEnvOrFlag("SERVER_ADDRESS", addrFlag, "127.0.0.1:8080")
-	baseURL := getEnvOrFlag("BASE_URL", baseURLFlag, "http://127.0.0.1:8080")
-	fileStorage := getEnvOrFlag("FILE_STORAGE_PATH", fileFlag, "./")
-	dataBaseDsn := getEnvOrFlag("DATABASE_DSN", dataBaseFlag, "")
+	// Файл конфигурации уступает переменным окружения и флагам
+	fileSettings, err := readConfigFile(getEnvOrFlag("CONFIG", configFlag, ""))
+	if err != nil {
+		return nil, err
+	}
+	setting := func(envKey, flagValue, defaultValue string) string {
+		if v, ok := fileSettings[strings.ToLower(envKey)]; ok {
+			defaultValue = v
+		}
+		return getEnvOrFlag(envKey, flagValue, defaultValue)
+	}
+
+	serverAddress := setting("SERVER_ADDRESS", addrFlag, "127.0.0.1:8080")
+	baseURL := setting("BASE_URL", baseURLFlag, "http://127.0.0.1:8080")
+	fileStorage := setting("FILE_STORAGE_PATH", fileFlag, "./")
+	dataBaseDsn := setting("DATABASE_DSN", dataBaseFlag, "")
+	idGenerator := setting("ID_GENERATOR", idGenFlag, "base36")
+	hashKey := setting("ID_HASH_KEY", hashKeyFlag, "")
+	geoHeader := setting("GEO_HEADER", geoFlag, "X-Country-Code")
+	pendingFallback := setting("PENDING_URL", pendingURL, "")
+	pendingMessage := setting("PENDING_MESSAGE", pendingText, DefaultPendingMessage)
+	if pendingFallback != "" {
+		if _, err := url.ParseRequestURI(pendingFallback); err != nil {
+			return nil, fmt.Errorf("некорректный адрес для неактивных ссылок: %q", pendingFallback)
+		}
+	}
+
+	hashPerUserValue := setting("ID_HASH_PER_USER", perUserFlag, "false")
+	hashPerUser, err := strconv.ParseBool(hashPerUserValue)
+	if err != nil {
+		return nil, fmt.Errorf("некорректное значение ID_HASH_PER_USER: %q", hashPerUserValue)
+	}
+
+	idLengthValue := setting("ID_LENGTH", idLenFlag, "8")
+	idLength, err := strconv.Atoi(idLengthValue)
+	if err != nil || idLength <= 0 {
+		return nil, fmt.Errorf("некорректная длина идентификатора: %q", idLengthValue)
+	}
+
+	denyList, err := readDenyList(setting("DENY_LIST_PATH", denyListFlag, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	expireValue := setting("EXPIRE_INTERVAL", expireFlag, "1m")
+	expireInterval, err := time.ParseDuration(expireValue)
+	if err != nil || expireInterval <= 0 {
+		return nil, fmt.Errorf("некорректный период проверки истёкших ссылок: %q", expireValue)
+	}
+
+	clickBufferValue := setting("CLICK_BUFFER", clickBufFlag, "1000")
+	clickBuffer, err := strconv.Atoi(clickBufferValue)
+	if err != nil || clickBuffer <= 0 {
+		return nil, fmt.Errorf("некорректная ёмкость очереди переходов: %q", clickBufferValue)
+	}
+
+	clickFlushValue := setting("CLICK_FLUSH_INTERVAL", clickFlush, "5s")
+	clickFlushInterval, err := time.ParseDuration(clickFlushValue)
+	if err != nil || clickFlushInterval <= 0 {
+		return nil, fmt.Errorf("некорректный период записи переходов: %q", clickFlushValue)
+	}
+
+	var trustedSubnet *net.IPNet
+	if subnetValue := setting("TRUSTED_SUBNET", subnetFlag, ""); subnetValue != "" {
+		_, trustedSubnet, err = net.ParseCIDR(subnetValue)
+		if err != nil {
+			return nil, fmt.Errorf("некорректная доверенная подсеть: %q", subnetValue)
+		}
+	}
+
+	var trustedProxies []*net.IPNet
+	for _, proxyValue := range strings.Split(setting("TRUSTED_PROXIES", proxiesFlag, ""), ",") {
+		if proxyValue = strings.TrimSpace(proxyValue); proxyValue == "" {
+			continue
+		}
+		_, proxy, err := net.ParseCIDR(proxyValue)
+		if err != nil {
+			return nil, fmt.Errorf("некорректная подсеть прокси: %q", proxyValue)
+		}
+		trustedProxies = append(trustedProxies, proxy)
+	}
+
+	qrSizeValue := setting("QR_SIZE", qrSizeFlag, "256")
+	qrSize, err := strconv.Atoi(qrSizeValue)
+	if err != nil || qrSize < internal.MinQRSize || qrSize > internal.MaxQRSize {
+		return nil, fmt.Errorf("некорректная ширина QR-кода: %q, нужно от %d до %d", qrSizeValue, internal.MinQRSize, internal.MaxQRSize)
+	}
+	qrLevel := strings.ToUpper(setting("QR_LEVEL", qrLevelFlag, "M"))
+	if _, err := internal.ParseQRLevel(qrLevel); err != nil {
+		return nil, err
+	}
+	qrMarginValue := setting("QR_MARGIN", qrMarginFlag, "4")
+	qrMargin, err := strconv.Atoi(qrMarginValue)
+	if err != nil || qrMargin < 0 || qrMargin > internal.MaxQRMargin {
+		return nil, fmt.Errorf("некорректное поле QR-кода: %q, нужно от 0 до %d", qrMarginValue, internal.MaxQRMargin)
+	}
+
+	enrichWorkersValue := setting("ENRICH_WORKERS", enrichFlag, "4")
+	enrichWorkers, err := strconv.Atoi(enrichWorkersValue)
+	if err != nil || enrichWorkers <= 0 {
+		return nil, fmt.Errorf("некорректное число загрузчиков сведений: %q", enrichWorkersValue)
+	}
+	enrichTimeoutValue := setting("ENRICH_TIMEOUT", enrichTime, "5s")
+	enrichTimeout, err := time.ParseDuration(enrichTimeoutValue)
+	if err != nil || enrichTimeout <= 0 {
+		return nil, fmt.Errorf("некорректное время загрузки сведений: %q", enrichTimeoutValue)
+	}
+	enrichBytesValue := setting("ENRICH_MAX_BYTES", enrichBytes, "262144")
+	enrichMaxBytes, err := strconv.ParseInt(enrichBytesValue, 10, 64)
+	if err != nil || enrichMaxBytes <= 0 {
+		return nil, fmt.Errorf("некорректный объём загрузки сведений: %q", enrichBytesValue)
+	}
+
+	healthIntervalValue := setting("HEALTH_INTERVAL", healthFlag, "1h")
+	healthInterval, err := time.ParseDuration(healthIntervalValue)
+	if err != nil || healthInterval < 0 {
+		return nil, fmt.Errorf("некорректный период проверки адресов: %q", healthIntervalValue)
+	}
+	healthWorkersValue := setting("HEALTH_WORKERS", healthWork, "8")
+	healthWorkers, err := strconv.Atoi(healthWorkersValue)
+	if err != nil || healthWorkers <= 0 {
+		return nil, fmt.Errorf("некорректное число проверок адресов: %q", healthWorkersValue)
+	}
+	healthDelayValue := setting("HEALTH_HOST_DELAY", healthDelay, "1s")
+	healthHostDelay, err := time.ParseDuration(healthDelayValue)
+	if err != nil || healthHostDelay < 0 {
+		return nil, fmt.Errorf("некорректная пауза проверки адресов: %q", healthDelayValue)
+	}
+	healthTimeoutValue := setting("HEALTH_TIMEOUT", healthTime, "10s")
+	healthTimeout, err := time.ParseDuration(healthTimeoutValue)
+	if err != nil || healthTimeout <= 0 {
+		return nil, fmt.Errorf("некорректное время проверки адреса: %q", healthTimeoutValue)
+	}
+
+	probeValue := setting("FALLBACK_PROBE_INTERVAL", probeFlag, "1m")
+	probeInterval, err := time.ParseDuration(probeValue)
+	if err != nil || probeInterval < 0 {
+		return nil, fmt.Errorf("некорректный период проверки запасных адресов: %q", probeValue)
+	}
+
+	redirectValue := setting("REDIRECT_CODE", redirectFlag, strconv.Itoa(DefaultRedirectCode))
+	redirectCode, err := strconv.Atoi(redirectValue)
+	if err != nil || !ValidRedirectCode(redirectCode) {
+		return nil, fmt.Errorf("некорректный код перенаправления: %q", redirectValue)
+	}
 
-	_, err := net.ResolveTCPAddr("tcp", serverAddress)
+	_, err = net.ResolveTCPAddr("tcp", serverAddress)
 	if err != nil {
 		serverAddress = "127.0.0.1:8080"
 		baseURL = "http://127.0.0.1:8080"
@@ -104,7 +516,22 @@ func InitConfig() (*Config, error) {
 		BaseURL(baseURL).
 		Storage(fileStorage).
 		DataBase(dataBaseDsn).
-		TypeStorage(typeStor)
+		TypeStorage(typeStor).
+		IDGenerator(idGenerator).
+		IDLength(idLength).
+		IDHash(hashKey, hashPerUser).
+		DenyList(denyList).
+		ExpireInterval(expireInterval).
+		RedirectCode(redirectCode).
+		GeoHeader(geoHeader).
+		Pending(pendingFallback, pendingMessage).
+		Clicks(clickBuffer, clickFlushInterval).
+		TrustedSubnet(trustedSubnet).
+		TrustedProxies(trustedProxies).
+		QR(qrSize, qrLevel, qrMargin).
+		Enrich(enrichWorkers, enrichTimeout, enrichMaxBytes).
+		Health(healthInterval, healthWorkers, healthHostDelay, healthTimeout).
+		FallbackProbe(probeInterval)
 
 	return builder.Build(), nil
 }
@@ -1 +1,32 @@
 package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{"ENRICH_MAX_BYTES": 1000000, "health_timeout": "5s", "ID_HASH_PER_USER": true, "ID_LENGTH": 8}`
+	if err := os.WriteFile(path, []byte(data), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := readConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"enrich_max_bytes": "1000000",
+		"health_timeout":   "5s",
+		"id_hash_per_user": "true",
+		"id_length":        "8",
+	}
+	for key, value := range want {
+		if settings[key] != value {
+			t.Errorf("Ожидалось %s = %q, получили %q", key, value, settings[key])
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// feistelRounds — число раундов сети Фейстеля в перестановке счётчика.
+const feistelRounds = 4
+
+// maxCounterLength — самая длинная строка base36, которая помещается в uint64 без переполнения.
+const maxCounterLength = 12
+
+var ErrCounterExhausted = errors.New("счётчик идентификаторов исчерпан")
+
+// Sequence выдаёт монотонно растущие значения счётчика. Реализуется хранилищем.
+type Sequence interface {
+	NextSequence() (uint64, error)
+}
+
+// CounterGenerator кодирует значение счётчика ключевой перестановкой, поэтому
+// идентификаторы получаются короткими, не повторяются и не идут подряд.
+//
+// Значения, для записи которых хватает n символов, переставляются внутри
+// [0, len(Alphabet)^n) и записываются ровно n символами, так что разные длины
+// не пересекаются. Алфавит должен быть в одном регистре, иначе при поиске без
+// учёта регистра разные значения дали бы одну ссылку.
+type CounterGenerator struct {
+	Sequence  Sequence
+	Key       []byte
+	Alphabet  string
+	MinLength int
+}
+
+func (g CounterGenerator) Generate(_, _ string, _ int) (string, error) {
+	n, err := g.Sequence.NextSequence()
+	if err != nil {
+		return "", err
+	}
+
+	return g.Encode(n)
+}
+
+// Encode переводит значение счётчика в идентификатор.
+func (g CounterGenerator) Encode(n uint64) (string, error) {
+	length := g.MinLength
+	for n >= g.domain(length) {
+		length++
+		if length > maxCounterLength {
+			return "", ErrCounterExhausted
+		}
+	}
+
+	v := g.permute(n, length, false)
+
+	base := uint64(len(g.Alphabet))
+	result := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		result[i] = g.Alphabet[v%base]
+		v /= base
+	}
+
+	return string(result), nil
+}
+
+// Decode восстанавливает значение счётчика по идентификатору.
+func (g CounterGenerator) Decode(id string) (uint64, error) {
+	length := len(id)
+	if length < g.MinLength || length > maxCounterLength {
+		return 0, fmt.Errorf("некорректная длина идентификатора: %d", length)
+	}
+
+	base := uint64(len(g.Alphabet))
+	var v uint64
+	for _, c := range id {
+		idx := strings.IndexRune(g.Alphabet, c)
+		if idx < 0 {
+			return 0, fmt.Errorf("недопустимый символ %q", c)
+		}
+		v = v*base + uint64(idx)
+	}
+
+	n := g.permute(v, length, true)
+	if length > g.MinLength && n < g.domain(length-1) {
+		return 0, fmt.Errorf("идентификатор %q не выдавался счётчиком", id)
+	}
+	return n, nil
+}
+
+// domain возвращает число значений, записываемых length символами.
+func (g CounterGenerator) domain(length int) uint64 {
+	d := uint64(1)
+	for i := 0; i < length; i++ {
+		d *= uint64(len(g.Alphabet))
+	}
+	return d
+}
+
+// permute — перестановка [0, domain(length)) сетью Фейстеля с обходом цикла:
+// шифр работает на ближайшей сверху чётной степени двойки, а значения за
+// пределами домена шифруются повторно, пока не попадут в него.
+func (g CounterGenerator) permute(v uint64, length int, inverse bool) uint64 {
+	domain := g.domain(length)
+	width := bits.Len64(domain - 1)
+	width += width % 2
+	half := uint(width / 2)
+	mask := uint64(1)<<half - 1
+
+	for {
+		left, right := v>>half, v&mask
+		if inverse {
+			for round := feistelRounds - 1; round >= 0; round-- {
+				left, right = right^(g.round(length, round, left)&mask), left
+			}
+		} else {
+			for round := 0; round < feistelRounds; round++ {
+				left, right = right, left^(g.round(length, round, right)&mask)
+			}
+		}
+
+		v = left<<half | right
+		if v < domain {
+			return v
+		}
+	}
+}
+
+func (g CounterGenerator) round(length, round int, value uint64) uint64 {
+	var buf [10]byte
+	buf[0] = byte(length)
+	buf[1] = byte(round)
+	binary.BigEndian.PutUint64(buf[2:], value)
+
+	mac := hmac.New(sha256.New, g.Key)
+	mac.Write(buf[:])
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
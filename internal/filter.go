@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// maxFilterAttempts ограничивает число кандидатов, отброшенных фильтром подряд.
+const maxFilterAttempts = 10
+
+// DefaultReserved — слова, которые не совпадают с маршрутами роутера, но заняты сервисом.
+var DefaultReserved = []string{"admin", "static", "health"}
+
+// DefaultDenied используется, когда в конфигурации не задан свой список запрещённых слов.
+var DefaultDenied = []string{"fuck", "shit", "cunt", "dick", "cock", "piss", "porn", "nazi", "hui", "pizd", "blya", "ebat"}
+
+var (
+	ErrRejectedSlug = errors.New("идентификатор запрещён")
+	ErrNoAllowedID  = errors.New("генератор не выдал разрешённый идентификатор")
+)
+
+// SlugFilter отсеивает идентификаторы, совпадающие с путями сервиса или
+// содержащие запрещённые слова. Сравнение без учёта регистра, как и поиск ссылок.
+type SlugFilter struct {
+	reserved map[string]bool
+	denied   []string
+}
+
+func NewSlugFilter(reserved, denied []string) *SlugFilter {
+	f := &SlugFilter{reserved: make(map[string]bool, len(reserved))}
+	for _, word := range reserved {
+		f.reserved[strings.ToLower(word)] = true
+	}
+	for _, word := range denied {
+		if word = strings.ToLower(strings.TrimSpace(word)); word != "" {
+			f.denied = append(f.denied, word)
+		}
+	}
+	return f
+}
+
+// Check проверяет сгенерированный идентификатор: запрещённое слово отбрасывается
+// в любом месте строки, ведь кандидата всегда можно сгенерировать заново.
+func (f *SlugFilter) Check(slug string) error {
+	if err := f.checkReserved(slug); err != nil {
+		return err
+	}
+
+	lower := strings.ToLower(slug)
+	for _, word := range f.denied {
+		if strings.Contains(lower, word) {
+			return fmt.Errorf("%w: %q содержит запрещённое слово", ErrRejectedSlug, slug)
+		}
+	}
+	return nil
+}
+
+// CheckAlias проверяет алиас пользователя. Запрещённые слова сравниваются с целыми
+// словами алиаса, разделёнными "-" и "_", чтобы не отклонять peacock или dickens.
+func (f *SlugFilter) CheckAlias(alias string) error {
+	if err := f.checkReserved(alias); err != nil {
+		return err
+	}
+
+	tokens := strings.FieldsFunc(strings.ToLower(alias), func(r rune) bool {
+		return r == '-' || r == '_'
+	})
+	for _, token := range tokens {
+		for _, word := range f.denied {
+			if token == word {
+				return fmt.Errorf("%w: %q содержит запрещённое слово", ErrRejectedSlug, alias)
+			}
+		}
+	}
+	return nil
+}
+
+func (f *SlugFilter) checkReserved(slug string) error {
+	if f.reserved[strings.ToLower(slug)] {
+		return fmt.Errorf("%w: %q зарезервирован", ErrRejectedSlug, slug)
+	}
+	return nil
+}
+
+// FilteredGenerator повторяет генерацию, пока кандидат не пройдёт фильтр.
+type FilteredGenerator struct {
+	Next   IDGenerator
+	Filter *SlugFilter
+}
+
+func (g FilteredGenerator) Generate(longURL, userID string, attempt int) (string, error) {
+	for i := 0; i < maxFilterAttempts; i++ {
+		// Детерминированные генераторы получают свой номер попытки для каждого кандидата
+		id, err := g.Next.Generate(longURL, userID, attempt*maxFilterAttempts+i)
+		if err != nil {
+			return "", err
+		}
+		if g.Filter.Check(id) == nil {
+			return id, nil
+		}
+	}
+
+	return "", ErrNoAllowedID
+}
@@ -1,22 +1,191 @@
 package internal
 
 import (
-	mr "math/rand"
-	"time"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
 )
 
-const charset = "0123456789"
+// Ссылки ищутся без учёта регистра, поэтому генераторы пишут идентификаторы
+// в одном регистре: буквы разного регистра давали бы одну и ту же ссылку.
+const (
+	DigitsAlphabet = "0123456789"
+	Base36Alphabet = "0123456789abcdefghijklmnopqrstuvwxyz"
+	// Base62Alphabet допустим в алиасах, которые выбирает пользователь.
+	Base62Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	// UnambiguousAlphabet не содержит похожих друг на друга символов 0/o, 1/i/l.
+	UnambiguousAlphabet = "23456789abcdefghjkmnpqrstuvwxyz"
+)
+
+// Типы генераторов, которые можно выбрать в конфигурации.
+const (
+	GeneratorBase36 = "base36"
+	// GeneratorBase62 — прежнее название base36, оставлено для старых конфигураций.
+	GeneratorBase62      = "base62"
+	GeneratorUnambiguous = "unambiguous"
+	GeneratorDigits      = "digits"
+	GeneratorHash        = "hash"
+	GeneratorCounter     = "counter"
+)
+
+const DefaultIDLength = 8
+
+// IDGenerator выдаёт идентификаторы коротких ссылок. attempt — номер повторной
+// попытки после коллизии, начиная с нуля.
+type IDGenerator interface {
+	Generate(longURL, userID string, attempt int) (string, error)
+}
+
+// GeneratorOptions описывает генератор, выбранный в конфигурации.
+type GeneratorOptions struct {
+	Kind   string
+	Length int
+	// HashKey — секрет для GeneratorHash и GeneratorCounter.
+	HashKey string
+	// HashPerUser подмешивает пользователя к хэшу, когда дубли ищутся в пределах пользователя.
+	HashPerUser bool
+	// Sequence — счётчик хранилища для GeneratorCounter, Length для него — минимальная длина.
+	Sequence Sequence
+	// Filter, если задан, отбрасывает запрещённые идентификаторы.
+	Filter *SlugFilter
+}
+
+// RandomGenerator собирает идентификатор из криптографически случайных символов алфавита.
+type RandomGenerator struct {
+	Alphabet string
+	Length   int
+}
+
+func (g RandomGenerator) Generate(_, _ string, _ int) (string, error) {
+	max := big.NewInt(int64(len(g.Alphabet)))
+	result := make([]byte, g.Length)
 
-var seededRand *mr.Rand = mr.New(mr.NewSource(time.Now().UnixNano()))
+	for i := range result {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		result[i] = g.Alphabet[n.Int64()]
+	}
+
+	return string(result), nil
+}
+
+// HashGenerator выводит идентификатор из HMAC нормализованного адреса, поэтому
+// один и тот же адрес получает одну и ту же ссылку на любом экземпляре сервиса.
+type HashGenerator struct {
+	Key      []byte
+	Alphabet string
+	Length   int
+	PerUser  bool
+}
+
+func (g HashGenerator) Generate(longURL, userID string, attempt int) (string, error) {
+	mac := hmac.New(sha256.New, g.Key)
+	mac.Write([]byte(NormalizeURL(longURL)))
+	if g.PerUser {
+		mac.Write([]byte{0})
+		mac.Write([]byte(userID))
+	}
+	if attempt > 0 {
+		// Настоящая коллизия хэшей: следующая попытка детерминированно сдвигается
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], uint64(attempt))
+		mac.Write(buf[:])
+	}
+
+	return encodeDigest(mac.Sum(nil), g.Alphabet, g.Length)
+}
+
+func encodeDigest(digest []byte, alphabet string, length int) (string, error) {
+	n := new(big.Int).SetBytes(digest)
+	base := big.NewInt(int64(len(alphabet)))
+
+	limit := new(big.Int).Exp(base, big.NewInt(int64(length)), nil)
+	if limit.Cmp(new(big.Int).Lsh(big.NewInt(1), uint(len(digest)*8))) > 0 {
+		return "", fmt.Errorf("длина %d больше, чем позволяет хэш", length)
+	}
 
-func GenerateRandomString(length int) string {
 	result := make([]byte, length)
-	// charsetLength := big.NewInt(int64(len(charset)))
+	mod := new(big.Int)
+	for i := range result {
+		n.DivMod(n, base, mod)
+		result[i] = alphabet[mod.Int64()]
+	}
+
+	return string(result), nil
+}
+
+// NormalizeURL приводит адрес к виду, в котором одинаковые ссылки совпадают
+// побайтно: схема и хост в нижнем регистре, без порта по умолчанию и с путём "/".
+func NormalizeURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if port := u.Port(); (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		u.Host = u.Hostname()
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	return u.String()
+}
+
+// NewIDGenerator возвращает генератор по его описанию из конфигурации.
+// Пустое название и нулевая длина означают значения по умолчанию.
+func NewIDGenerator(opts GeneratorOptions) (IDGenerator, error) {
+	generator, err := newBaseGenerator(opts)
+	if err != nil || opts.Filter == nil {
+		return generator, err
+	}
+
+	return FilteredGenerator{Next: generator, Filter: opts.Filter}, nil
+}
+
+func newBaseGenerator(opts GeneratorOptions) (IDGenerator, error) {
+	length := opts.Length
+	if length == 0 {
+		length = DefaultIDLength
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("некорректная длина идентификатора: %d", length)
+	}
 
-	for i := 0; i < length; i++ {
-		n := seededRand.Int63n(int64(len(charset)))
-		result[i] = charset[n]
+	switch opts.Kind {
+	case "", GeneratorBase36, GeneratorBase62:
+		return RandomGenerator{Alphabet: Base36Alphabet, Length: length}, nil
+	case GeneratorUnambiguous:
+		return RandomGenerator{Alphabet: UnambiguousAlphabet, Length: length}, nil
+	case GeneratorDigits:
+		return RandomGenerator{Alphabet: DigitsAlphabet, Length: length}, nil
+	case GeneratorHash:
+		if opts.HashKey == "" {
+			return nil, errors.New("для генератора hash нужен ключ")
+		}
+		return HashGenerator{Key: []byte(opts.HashKey), Alphabet: Base36Alphabet, Length: length, PerUser: opts.HashPerUser}, nil
+	case GeneratorCounter:
+		if opts.HashKey == "" {
+			return nil, errors.New("для генератора counter нужен ключ")
+		}
+		if opts.Sequence == nil {
+			return nil, errors.New("для генератора counter нужен счётчик хранилища")
+		}
+		if length > maxCounterLength {
+			return nil, fmt.Errorf("для генератора counter длина не больше %d", maxCounterLength)
+		}
+		return CounterGenerator{Sequence: opts.Sequence, Key: []byte(opts.HashKey), Alphabet: Base36Alphabet, MinLength: length}, nil
 	}
 
-	return string(result)
+	return nil, fmt.Errorf("неизвестный генератор идентификаторов: %q", opts.Kind)
 }
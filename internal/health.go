@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// LinkChecker проверяет, отвечает ли адрес назначения. Возвращает код ответа;
+// ошибка означает, что ответа не было вовсе.
+type LinkChecker interface {
+	Check(ctx context.Context, rawURL string) (status int, err error)
+}
+
+// HTTPLinkChecker проверяет адрес запросом HEAD, а если сайт его не
+// поддерживает — запросом GET без чтения тела.
+type HTTPLinkChecker struct {
+	Client *http.Client
+}
+
+// NewHTTPLinkChecker возвращает проверку, которая не ходит во внутреннюю сеть.
+func NewHTTPLinkChecker(timeout time.Duration) *HTTPLinkChecker {
+	return &HTTPLinkChecker{Client: guardedClient(timeout)}
+}
+
+func (c *HTTPLinkChecker) Check(ctx context.Context, rawURL string) (int, error) {
+	status, err := c.do(ctx, http.MethodHead, rawURL)
+	if err != nil {
+		return 0, err
+	}
+
+	switch status {
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented, http.StatusForbidden:
+		return c.do(ctx, http.MethodGet, rawURL)
+	}
+	return status, nil
+}
+
+func (c *HTTPLinkChecker) do(ctx context.Context, method, rawURL string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	// Немного дочитываем тело, чтобы соединение вернулось в пул
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
+
+// HealthyStatus сообщает, считается ли код ответа рабочим адресом.
+func HealthyStatus(status int) bool {
+	return status >= 200 && status < 400
+}
@@ -1 +1,428 @@
 package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewIDGenerator(t *testing.T) {
+	generator, err := NewIDGenerator(GeneratorOptions{Kind: GeneratorUnambiguous, Length: 12})
+	if err != nil {
+		t.Fatalf("Ошибка создания генератора: %v", err)
+	}
+
+	id, err := generator.Generate("https://example.com", "u1", 0)
+	if err != nil {
+		t.Fatalf("Ошибка генерации: %v", err)
+	}
+
+	if len(id) != 12 {
+		t.Errorf("Ожидалась длина 12, но получили %d", len(id))
+	}
+	for _, c := range id {
+		if !strings.ContainsRune(UnambiguousAlphabet, c) {
+			t.Errorf("Символ %q не входит в алфавит", c)
+		}
+	}
+
+	if _, err := NewIDGenerator(GeneratorOptions{Kind: "unknown"}); err == nil {
+		t.Error("Ожидалась ошибка для неизвестного генератора")
+	}
+}
+
+func TestValidateAlias(t *testing.T) {
+	filter := NewSlugFilter([]string{"api", "ping"}, []string{"bad"})
+
+	for _, alias := range []string{"spring-sale_2024", "badminton", "sinbad-voyage"} {
+		if err := ValidateAlias(alias, filter); err != nil {
+			t.Errorf("Алиас %q должен быть допустимым: %v", alias, err)
+		}
+	}
+
+	// Сгенерированный идентификатор отклоняется и за вхождение внутри слова
+	if err := filter.Check("badminton"); !errors.Is(err, ErrRejectedSlug) {
+		t.Errorf("Идентификатор должен быть отклонён, получили %v", err)
+	}
+
+	for _, alias := range []string{"ab", strings.Repeat("a", MaxAliasLength+1), "spring sale", "весна", "API", "not-BAD-at-all"} {
+		if err := ValidateAlias(alias, filter); !errors.Is(err, ErrInvalidAlias) {
+			t.Errorf("Алиас %q должен быть отклонён, получили %v", alias, err)
+		}
+	}
+}
+
+func TestHashGenerator(t *testing.T) {
+	generator, err := NewIDGenerator(GeneratorOptions{Kind: GeneratorHash, HashKey: "secret", Length: 10})
+	if err != nil {
+		t.Fatalf("Ошибка создания генератора: %v", err)
+	}
+
+	first, _ := generator.Generate("https://Example.com:443", "u1", 0)
+	second, _ := generator.Generate("https://example.com/", "u2", 0)
+	if first != second || len(first) != 10 {
+		t.Errorf("Один адрес должен давать один идентификатор: %s и %s", first, second)
+	}
+
+	if retry, _ := generator.Generate("https://example.com/", "u1", 1); retry == first {
+		t.Error("Повторная попытка должна давать другой идентификатор")
+	}
+
+	perUser, _ := NewIDGenerator(GeneratorOptions{Kind: GeneratorHash, HashKey: "secret", HashPerUser: true})
+	a, _ := perUser.Generate("https://example.com/", "u1", 0)
+	b, _ := perUser.Generate("https://example.com/", "u2", 0)
+	if a == b {
+		t.Error("С HashPerUser разные пользователи должны получать разные идентификаторы")
+	}
+
+	if _, err := NewIDGenerator(GeneratorOptions{Kind: GeneratorHash}); err == nil {
+		t.Error("Ожидалась ошибка без ключа")
+	}
+}
+
+type memorySequence struct {
+	n uint64
+}
+
+func (s *memorySequence) NextSequence() (uint64, error) {
+	s.n++
+	return s.n, nil
+}
+
+func TestCounterGenerator(t *testing.T) {
+	generator := CounterGenerator{Sequence: &memorySequence{}, Key: []byte("secret"), Alphabet: Base36Alphabet, MinLength: 1}
+
+	seen := make(map[string]bool)
+	for n := uint64(0); n < 5000; n++ {
+		id, err := generator.Encode(n)
+		if err != nil {
+			t.Fatalf("Ошибка кодирования %d: %v", n, err)
+		}
+		if seen[id] {
+			t.Fatalf("Идентификатор %s выдан повторно", id)
+		}
+		seen[id] = true
+
+		if decoded, err := generator.Decode(id); err != nil || decoded != n {
+			t.Fatalf("Ожидалось %d после декодирования %s, получили %d, %v", n, id, decoded, err)
+		}
+	}
+
+	if id, _ := generator.Encode(35); len(id) != 1 {
+		t.Errorf("Значение 35 должно умещаться в один символ, получили %s", id)
+	}
+	if id, _ := generator.Encode(36); len(id) != 2 {
+		t.Errorf("Значение 36 должно занимать два символа, получили %s", id)
+	}
+	// Самое большое значение из maxCounterLength символов не переполняет uint64
+	if id, err := generator.Encode(generator.domain(maxCounterLength) - 1); err != nil || len(id) != maxCounterLength {
+		t.Errorf("Ожидался идентификатор из %d символов, получили %s, %v", maxCounterLength, id, err)
+	}
+
+	first, _ := generator.Generate("", "", 0)
+	second, _ := generator.Generate("", "", 0)
+	if first == second {
+		t.Error("Последовательные значения счётчика должны давать разные идентификаторы")
+	}
+}
+
+type listGenerator struct {
+	ids []string
+}
+
+func (g *listGenerator) Generate(_, _ string, attempt int) (string, error) {
+	return g.ids[attempt%len(g.ids)], nil
+}
+
+func TestFilteredGenerator(t *testing.T) {
+	filter := NewSlugFilter([]string{"api"}, []string{"bad"})
+	generator := FilteredGenerator{Next: &listGenerator{ids: []string{"API", "xBaDx", "good"}}, Filter: filter}
+
+	id, err := generator.Generate("https://example.com", "u1", 0)
+	if err != nil || id != "good" {
+		t.Errorf("Ожидался идентификатор good, получили %q, %v", id, err)
+	}
+
+	rejecting := FilteredGenerator{Next: &listGenerator{ids: []string{"api"}}, Filter: filter}
+	if _, err := rejecting.Generate("https://example.com", "u1", 0); !errors.Is(err, ErrNoAllowedID) {
+		t.Errorf("Ожидалась ошибка ErrNoAllowedID, получили %v", err)
+	}
+}
+
+func TestPBKDF2Vector(t *testing.T) {
+	// RFC 7914, раздел 11: PBKDF2-HMAC-SHA256("passwd", "salt", 1, 64)
+	got := hex.EncodeToString(pbkdf2([]byte("passwd"), []byte("salt"), 1, 64))
+	want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if got != want {
+		t.Errorf("Неверный результат PBKDF2: %s", got)
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := HashPassword("s3cret")
+	if err != nil {
+		t.Fatalf("Ошибка хэширования: %v", err)
+	}
+
+	if ok, err := CheckPassword(hash, "s3cret"); err != nil || !ok {
+		t.Errorf("Верный пароль не принят: %v", err)
+	}
+	if ok, _ := CheckPassword(hash, "wrong"); ok {
+		t.Error("Неверный пароль принят")
+	}
+
+	other, _ := HashPassword("s3cret")
+	if other == hash {
+		t.Error("Хэши одного пароля должны различаться солью")
+	}
+}
+
+func TestQRTables(t *testing.T) {
+	// Пример HELLO WORLD, версия 1-M, из разбора стандарта на thonky.com
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := rsRemainder(data, rsDivisor(10)); !bytes.Equal(got, want) {
+		t.Errorf("Коды Рида — Соломона: ожидались %v, получили %v", want, got)
+	}
+
+	formats := []struct {
+		level QRLevel
+		mask  int
+		want  int
+	}{
+		{QRLevelL, 0, 0b111011111000100},
+		{QRLevelL, 1, 0b111001011110011},
+		{QRLevelM, 0, 0b101010000010010},
+		{QRLevelQ, 0, 0b011010101011111},
+		{QRLevelH, 0, 0b001011010001001},
+	}
+	for _, f := range formats {
+		if got := qrFormatBits(f.level, f.mask); got != f.want {
+			t.Errorf("Строка формата %d/%d: ожидалась %015b, получили %015b", f.level, f.mask, f.want, got)
+		}
+	}
+
+	if got := qrVersionBits(7); got != 0x07C94 {
+		t.Errorf("Информация о версии 7: ожидалась 0x07C94, получили %#x", got)
+	}
+
+	alignments := map[int][]int{
+		2:  {6, 18},
+		7:  {6, 22, 38},
+		32: {6, 34, 60, 86, 112, 138},
+		36: {6, 24, 50, 76, 102, 128, 154},
+		40: {6, 30, 58, 86, 114, 142, 170},
+	}
+	for version, want := range alignments {
+		if got := qrAlignmentPositions(version); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("Выравнивание версии %d: ожидалось %v, получили %v", version, want, got)
+		}
+	}
+
+	capacities := []struct {
+		version int
+		level   QRLevel
+		want    int
+	}{
+		{1, QRLevelL, 19}, {1, QRLevelH, 9}, {5, QRLevelQ, 62}, {40, QRLevelL, 2956}, {40, QRLevelH, 1276},
+	}
+	for _, c := range capacities {
+		if got := qrDataCodewords(c.version, c.level); got != c.want {
+			t.Errorf("Ёмкость %d/%d: ожидалось %d, получили %d", c.version, c.level, c.want, got)
+		}
+	}
+}
+
+// TestEncodeQRRoundTrip читает код обратно: строку формата, маску и данные.
+func TestEncodeQRRoundTrip(t *testing.T) {
+	for _, text := range []string{"http://localhost:8080/Ab3dE9fG", strings.Repeat("https://example.com/", 20)} {
+		for level := QRLevelL; level <= QRLevelH; level++ {
+			q, err := EncodeQR([]byte(text), level)
+			if err != nil {
+				t.Fatalf("Ошибка кодирования: %v", err)
+			}
+
+			var format int
+			for i := 0; i <= 5; i++ {
+				format |= qrBit(q.Dark(8, i)) << i
+			}
+			format |= qrBit(q.Dark(8, 7))<<6 | qrBit(q.Dark(8, 8))<<7 | qrBit(q.Dark(7, 8))<<8
+			for i := 9; i < 15; i++ {
+				format |= qrBit(q.Dark(14-i, 8)) << i
+			}
+			mask := (format ^ 0x5412) >> 10 & 7
+			if qrFormatBits(level, mask) != format {
+				t.Fatalf("Строка формата %015b не соответствует уровню %d", format, level)
+			}
+
+			// Снимаем маску и собираем кодовые слова тем же обходом, что и при записи
+			clean := newQRCode(q.Version)
+			clean.drawFunctionPatterns(level)
+			for y := 0; y < q.Size; y++ {
+				for x := 0; x < q.Size; x++ {
+					clean.modules[y][x] = q.Dark(x, y) != (!clean.isFunction[y][x] && qrMaskBit(mask, x, y))
+				}
+			}
+			raw := make([]byte, qrRawModules(q.Version)/8)
+			i := 0
+			for right := q.Size - 1; right >= 1; right -= 2 {
+				if right == 6 {
+					right = 5
+				}
+				for vert := 0; vert < q.Size; vert++ {
+					for j := 0; j < 2; j++ {
+						x, y := right-j, vert
+						if (right+1)&2 == 0 {
+							y = q.Size - 1 - vert
+						}
+						if !clean.isFunction[y][x] && i < len(raw)*8 {
+							raw[i>>3] |= byte(qrBit(clean.modules[y][x])) << (7 - i&7)
+							i++
+						}
+					}
+				}
+			}
+
+			// Блоки данных идут первыми: берём по кодовому слову из каждого блока по очереди
+			numBlocks := qrNumBlocks[level][q.Version]
+			numShort := numBlocks - len(raw)%numBlocks
+			dataLen := len(raw)/numBlocks - qrECCPerBlock[level][q.Version]
+			blocks := make([][]byte, numBlocks)
+			k := 0
+			for col := 0; col <= dataLen; col++ {
+				for b := range blocks {
+					if col < dataLen || b >= numShort {
+						blocks[b] = append(blocks[b], raw[k])
+						k++
+					}
+				}
+			}
+			data := bytes.Join(blocks, nil)
+
+			if data[0]>>4 != 0x4 {
+				t.Fatalf("Ожидался байтовый режим, получили %x", data[0]>>4)
+			}
+			var length, offset int
+			if q.Version <= 9 {
+				length, offset = int(data[0]&0xF)<<4|int(data[1]>>4), 1
+			} else {
+				length, offset = int(data[0]&0xF)<<12|int(data[1])<<4|int(data[2]>>4), 2
+			}
+			decoded := make([]byte, length)
+			for n := range decoded {
+				decoded[n] = data[offset+n]<<4 | data[offset+n+1]>>4
+			}
+			if string(decoded) != text {
+				t.Errorf("Уровень %d: прочитано %q вместо %q", level, decoded, text)
+			}
+		}
+	}
+
+	if _, err := EncodeQR(make([]byte, 3000), QRLevelL); !errors.Is(err, ErrQRTooLong) {
+		t.Errorf("Ожидалась ErrQRTooLong, получили %v", err)
+	}
+}
+
+func qrBit(dark bool) int {
+	if dark {
+		return 1
+	}
+	return 0
+}
+
+func TestHTTPMetadataFetcher(t *testing.T) {
+	page := `<html><head>
+		<TITLE> Главная &amp; новости </TITLE>
+		<meta property="og:title" content="Не тот заголовок">
+		<meta name='description' content="Описание
+			страницы">
+		<link rel="shortcut icon" href="/static/icon.png">
+	</head><body></body></html>`
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/json":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{}`))
+		case "/big":
+			// Заголовок за пределами MaxBytes не читается
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(strings.Repeat(" ", 4096) + `<title>Поздний</title>`))
+		case "/bare":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<meta property="og:description" content="Из OpenGraph">`))
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(page))
+		}
+	}))
+	defer srv.Close()
+
+	fetcher := &HTTPMetadataFetcher{Client: srv.Client(), MaxBytes: 1024}
+
+	meta, err := fetcher.Fetch(context.Background(), srv.URL+"/page")
+	if err != nil {
+		t.Fatalf("Ошибка загрузки: %v", err)
+	}
+	want := PageMetadata{Title: "Главная & новости", Description: "Описание страницы", Favicon: srv.URL + "/static/icon.png"}
+	if meta != want {
+		t.Errorf("Ожидалось %+v, получили %+v", want, meta)
+	}
+
+	meta, err = fetcher.Fetch(context.Background(), srv.URL+"/bare")
+	if err != nil {
+		t.Fatalf("Ошибка загрузки: %v", err)
+	}
+	if meta.Description != "Из OpenGraph" || meta.Favicon != srv.URL+"/favicon.ico" {
+		t.Errorf("Неожиданные сведения без заголовка и значка: %+v", meta)
+	}
+
+	meta, err = fetcher.Fetch(context.Background(), srv.URL+"/big")
+	if err != nil || meta.Title != "" {
+		t.Errorf("Страница прочитана дальше MaxBytes: %+v, %v", meta, err)
+	}
+
+	if _, err := fetcher.Fetch(context.Background(), srv.URL+"/json"); err == nil {
+		t.Error("Ожидалась ошибка для страницы не в HTML")
+	}
+
+	// Загрузчик сервиса не обращается к адресам внутренней сети
+	guarded := NewHTTPMetadataFetcher(time.Second, 1024)
+	if _, err := guarded.Fetch(context.Background(), srv.URL); !errors.Is(err, ErrPrivateAddress) {
+		t.Errorf("Ожидалась ErrPrivateAddress, получили %v", err)
+	}
+}
+
+func TestHTTPLinkChecker(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodHead:
+			// Часть сайтов не отвечает на HEAD
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer srv.Close()
+
+	checker := &HTTPLinkChecker{Client: srv.Client()}
+
+	status, err := checker.Check(context.Background(), srv.URL+"/page")
+	if err != nil || status != http.StatusOK {
+		t.Errorf("Ожидался 200 после GET, получили %d, %v", status, err)
+	}
+
+	status, err = checker.Check(context.Background(), srv.URL+"/missing")
+	if err != nil || HealthyStatus(status) {
+		t.Errorf("Ожидался нерабочий код, получили %d, %v", status, err)
+	}
+}
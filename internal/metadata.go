@@ -0,0 +1,197 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// maxMetadataText ограничивает длину заголовка и описания в символах.
+	maxMetadataText = 300
+	maxRedirects    = 5
+)
+
+var ErrPrivateAddress = errors.New("адрес во внутренней сети")
+
+// PageMetadata — сведения о странице назначения ссылки.
+type PageMetadata struct {
+	Title       string
+	Description string
+	Favicon     string
+}
+
+// MetadataFetcher получает сведения о странице по её адресу.
+type MetadataFetcher interface {
+	Fetch(ctx context.Context, rawURL string) (PageMetadata, error)
+}
+
+// HTTPMetadataFetcher загружает страницу и разбирает из неё заголовок,
+// описание и значок. Читается не больше MaxBytes байт ответа.
+type HTTPMetadataFetcher struct {
+	Client   *http.Client
+	MaxBytes int64
+}
+
+// NewHTTPMetadataFetcher возвращает загрузчик, который не ходит во внутреннюю сеть
+// и ограничивает время каждого запроса.
+func NewHTTPMetadataFetcher(timeout time.Duration, maxBytes int64) *HTTPMetadataFetcher {
+	return &HTTPMetadataFetcher{Client: guardedClient(timeout), MaxBytes: maxBytes}
+}
+
+// guardedClient — HTTP-клиент для адресов пользователей: с ограничением времени
+// и перенаправлений и без доступа к внутренней сети.
+func guardedClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		// Проверяется адрес после разрешения имени, поэтому DNS не обходит запрет
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return fmt.Errorf("%w: %s", ErrPrivateAddress, host)
+			}
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return errors.New("слишком много перенаправлений")
+			}
+			return nil
+		},
+	}
+}
+
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+func (f *HTTPMetadataFetcher) Fetch(ctx context.Context, rawURL string) (PageMetadata, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return PageMetadata{}, err
+	}
+	req.Header.Set("Accept", "text/html")
+
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return PageMetadata{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return PageMetadata{}, fmt.Errorf("страница ответила %s", resp.Status)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return PageMetadata{}, fmt.Errorf("страница не HTML: %q", mediaType)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, f.MaxBytes))
+	if err != nil {
+		return PageMetadata{}, err
+	}
+
+	// Относительный значок разрешается от адреса после всех перенаправлений
+	return ParsePageMetadata(body, resp.Request.URL), nil
+}
+
+var (
+	titleTag  = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	headTag   = regexp.MustCompile(`(?is)<(meta|link)\b([^>]*)>`)
+	attribute = regexp.MustCompile(`(?s)([a-zA-Z:_-]+)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+	spaces    = regexp.MustCompile(`\s+`)
+)
+
+// ParsePageMetadata разбирает начало HTML-страницы. Без заданного значка
+// используется /favicon.ico сайта.
+func ParsePageMetadata(body []byte, base *url.URL) PageMetadata {
+	var meta PageMetadata
+	var ogTitle, ogDescription string
+
+	if m := titleTag.FindSubmatch(body); m != nil {
+		meta.Title = cleanText(string(m[1]))
+	}
+
+	for _, tag := range headTag.FindAllSubmatch(body, -1) {
+		attrs := make(map[string]string)
+		for _, a := range attribute.FindAllSubmatch(tag[2], -1) {
+			attrs[strings.ToLower(string(a[1]))] = string(a[2]) + string(a[3]) + string(a[4])
+		}
+
+		if strings.EqualFold(string(tag[1]), "meta") {
+			name := strings.ToLower(attrs["name"] + attrs["property"])
+			switch name {
+			case "description":
+				meta.Description = cleanText(attrs["content"])
+			case "og:description":
+				ogDescription = cleanText(attrs["content"])
+			case "og:title":
+				ogTitle = cleanText(attrs["content"])
+			}
+			continue
+		}
+
+		rel := strings.Fields(strings.ToLower(attrs["rel"]))
+		for _, r := range rel {
+			if (r == "icon" || r == "apple-touch-icon") && meta.Favicon == "" && attrs["href"] != "" {
+				meta.Favicon = resolveURL(base, html.UnescapeString(attrs["href"]))
+			}
+		}
+	}
+
+	if meta.Title == "" {
+		meta.Title = ogTitle
+	}
+	if meta.Description == "" {
+		meta.Description = ogDescription
+	}
+	if meta.Favicon == "" && base != nil {
+		meta.Favicon = resolveURL(base, "/favicon.ico")
+	}
+	return meta
+}
+
+func cleanText(s string) string {
+	s = strings.TrimSpace(spaces.ReplaceAllString(html.UnescapeString(s), " "))
+	if runes := []rune(s); len(runes) > maxMetadataText {
+		s = string(runes[:maxMetadataText])
+	}
+	return s
+}
+
+func resolveURL(base *url.URL, ref string) string {
+	u, err := url.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return ""
+	}
+	if base != nil {
+		u = base.ResolveReference(u)
+	}
+	// Значок с data: или javascript: в список не попадает
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ""
+	}
+	return u.String()
+}
@@ -0,0 +1,581 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+)
+
+// QRLevel — уровень коррекции ошибок QR-кода: доля модулей, которые можно
+// восстановить, примерно 7, 15, 25 и 30 процентов.
+type QRLevel int
+
+const (
+	QRLevelL QRLevel = iota
+	QRLevelM
+	QRLevelQ
+	QRLevelH
+)
+
+// Допустимые ширина QR-кода в пикселях и белое поле в модулях.
+const (
+	MinQRSize   = 32
+	MaxQRSize   = 4096
+	MaxQRMargin = 32
+)
+
+const (
+	qrMinVersion = 1
+	qrMaxVersion = 40
+)
+
+var ErrQRTooLong = errors.New("данные не помещаются в QR-код")
+
+// qrECCPerBlock и qrNumBlocks — число кодовых слов коррекции в блоке и число
+// блоков для каждой версии (индекс 0 не используется) по ISO/IEC 18004.
+var qrECCPerBlock = [4][qrMaxVersion + 1]int{
+	{-1, 7, 10, 15, 20, 26, 18, 20, 24, 30, 18, 20, 24, 26, 30, 22, 24, 28, 30, 28, 28, 28, 28, 30, 30, 26, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{-1, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28},
+	{-1, 13, 22, 18, 26, 18, 24, 18, 22, 20, 24, 28, 26, 24, 20, 30, 24, 28, 28, 26, 30, 28, 30, 30, 30, 30, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{-1, 17, 28, 22, 16, 22, 28, 26, 26, 24, 28, 24, 28, 22, 24, 24, 30, 28, 28, 26, 28, 30, 24, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+}
+
+var qrNumBlocks = [4][qrMaxVersion + 1]int{
+	{-1, 1, 1, 1, 1, 1, 2, 2, 2, 2, 4, 4, 4, 4, 4, 6, 6, 6, 6, 7, 8, 8, 9, 9, 10, 12, 12, 12, 13, 14, 15, 16, 17, 18, 19, 19, 20, 21, 22, 24, 25},
+	{-1, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49},
+	{-1, 1, 1, 2, 2, 4, 4, 6, 6, 8, 8, 8, 10, 12, 16, 12, 17, 16, 18, 21, 20, 23, 23, 25, 27, 29, 34, 34, 35, 38, 40, 43, 45, 48, 51, 53, 56, 59, 62, 65, 68},
+	{-1, 1, 1, 2, 4, 4, 4, 5, 6, 8, 8, 11, 11, 16, 16, 18, 16, 19, 21, 25, 25, 25, 34, 30, 32, 35, 37, 40, 42, 45, 48, 51, 54, 57, 60, 63, 66, 70, 74, 77, 81},
+}
+
+// qrFormatLevel — код уровня коррекции в строке формата.
+var qrFormatLevel = [4]int{1, 0, 3, 2}
+
+// ParseQRLevel читает уровень коррекции по букве L, M, Q или H.
+func ParseQRLevel(s string) (QRLevel, error) {
+	switch strings.ToUpper(s) {
+	case "L":
+		return QRLevelL, nil
+	case "M":
+		return QRLevelM, nil
+	case "Q":
+		return QRLevelQ, nil
+	case "H":
+		return QRLevelH, nil
+	}
+	return 0, fmt.Errorf("неизвестный уровень коррекции QR-кода: %q", s)
+}
+
+// QRCode — матрица модулей QR-кода.
+type QRCode struct {
+	Version int
+	Size    int
+
+	modules    [][]bool
+	isFunction [][]bool
+}
+
+// Dark сообщает, тёмный ли модуль в столбце x и строке y.
+func (q *QRCode) Dark(x, y int) bool {
+	return x >= 0 && y >= 0 && x < q.Size && y < q.Size && q.modules[y][x]
+}
+
+// EncodeQR кодирует данные в байтовом режиме в QR-код наименьшей подходящей
+// версии. Маска выбирается по штрафам стандарта.
+func EncodeQR(data []byte, level QRLevel) (*QRCode, error) {
+	if level < QRLevelL || level > QRLevelH {
+		return nil, fmt.Errorf("некорректный уровень коррекции QR-кода: %d", level)
+	}
+
+	version := 0
+	for v := qrMinVersion; v <= qrMaxVersion; v++ {
+		if 4+qrCountBits(v)+8*len(data) <= qrDataCodewords(v, level)*8 {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, ErrQRTooLong
+	}
+
+	// Режим 0100 (байты), длина, данные, терминатор и заполнение до ёмкости
+	capacity := qrDataCodewords(version, level) * 8
+	var bits qrBits
+	bits.append(0x4, 4)
+	bits.append(len(data), qrCountBits(version))
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	terminator := capacity - len(bits)
+	if terminator > 4 {
+		terminator = 4
+	}
+	bits.append(0, terminator)
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+
+	codewords := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		if bit {
+			codewords[i/8] |= 1 << (7 - i%8)
+		}
+	}
+
+	q := newQRCode(version)
+	q.drawFunctionPatterns(level)
+	q.drawCodewords(qrAddECC(codewords, version, level))
+
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(level, mask)
+		if penalty := q.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+		// Маска — XOR, повторное наложение её снимает
+		q.applyMask(mask)
+	}
+	q.applyMask(best)
+	q.drawFormatBits(level, best)
+
+	return q, nil
+}
+
+func newQRCode(version int) *QRCode {
+	size := version*4 + 17
+	q := &QRCode{Version: version, Size: size}
+	q.modules = make([][]bool, size)
+	q.isFunction = make([][]bool, size)
+	for i := range q.modules {
+		q.modules[i] = make([]bool, size)
+		q.isFunction[i] = make([]bool, size)
+	}
+	return q
+}
+
+type qrBits []bool
+
+func (b *qrBits) append(value, length int) {
+	for i := length - 1; i >= 0; i-- {
+		*b = append(*b, (value>>i)&1 != 0)
+	}
+}
+
+// qrCountBits — ширина поля длины в байтовом режиме.
+func qrCountBits(version int) int {
+	if version <= 9 {
+		return 8
+	}
+	return 16
+}
+
+// qrRawModules — число модулей версии, доступных под данные и коррекцию.
+func qrRawModules(version int) int {
+	result := (16*version+128)*version + 64
+	if version >= 2 {
+		numAlign := version/7 + 2
+		result -= (25*numAlign-10)*numAlign - 55
+		if version >= 7 {
+			result -= 36
+		}
+	}
+	return result
+}
+
+func qrDataCodewords(version int, level QRLevel) int {
+	return qrRawModules(version)/8 - qrECCPerBlock[level][version]*qrNumBlocks[level][version]
+}
+
+// qrAlignmentPositions — координаты центров выравнивающих узоров по одной оси.
+func qrAlignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+
+	numAlign := version/7 + 2
+	step := (version*8 + numAlign*3 + 5) / (numAlign*4 - 4) * 2
+	result := make([]int, numAlign)
+	result[0] = 6
+	for i, pos := numAlign-1, version*4+10; i >= 1; i, pos = i-1, pos-step {
+		result[i] = pos
+	}
+	return result
+}
+
+// qrAddECC делит данные на блоки, дописывает к каждому коды Рида — Соломона
+// и перемежает блоки.
+func qrAddECC(data []byte, version int, level QRLevel) []byte {
+	numBlocks := qrNumBlocks[level][version]
+	eccLen := qrECCPerBlock[level][version]
+	rawCodewords := qrRawModules(version) / 8
+	numShort := numBlocks - rawCodewords%numBlocks
+	shortLen := rawCodewords / numBlocks
+
+	divisor := rsDivisor(eccLen)
+	blocks := make([][]byte, numBlocks)
+	k := 0
+	for i := range blocks {
+		n := shortLen - eccLen
+		if i >= numShort {
+			n++
+		}
+		block := append([]byte(nil), data[k:k+n]...)
+		k += n
+		ecc := rsRemainder(block, divisor)
+		if i < numShort {
+			// Короткие блоки выравниваются пустым байтом, который пропускается при перемежении
+			block = append(block, 0)
+		}
+		blocks[i] = append(block, ecc...)
+	}
+
+	result := make([]byte, 0, rawCodewords)
+	for i := range blocks[0] {
+		for j, block := range blocks {
+			if i != shortLen-eccLen || j >= numShort {
+				result = append(result, block[i])
+			}
+		}
+	}
+	return result
+}
+
+// rsMultiply умножает в поле GF(2^8) с порождающим многочленом 0x11D.
+func rsMultiply(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+// rsDivisor возвращает коэффициенты порождающего многочлена степени degree
+// без старшего, от старших степеней к младшим.
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = rsMultiply(result[j], root)
+			if j+1 < degree {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = rsMultiply(root, 0x02)
+	}
+	return result
+}
+
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coef := range divisor {
+			result[i] ^= rsMultiply(coef, factor)
+		}
+	}
+	return result
+}
+
+func (q *QRCode) setFunction(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.isFunction[y][x] = true
+}
+
+func (q *QRCode) drawFunctionPatterns(level QRLevel) {
+	for i := 0; i < q.Size; i++ {
+		q.setFunction(6, i, i%2 == 0)
+		q.setFunction(i, 6, i%2 == 0)
+	}
+
+	q.drawFinder(3, 3)
+	q.drawFinder(q.Size-4, 3)
+	q.drawFinder(3, q.Size-4)
+
+	positions := qrAlignmentPositions(q.Version)
+	n := len(positions)
+	for i := range positions {
+		for j := range positions {
+			// Углы с поисковыми узорами пропускаются
+			if (i == 0 && j == 0) || (i == 0 && j == n-1) || (i == n-1 && j == 0) {
+				continue
+			}
+			q.drawAlignment(positions[i], positions[j])
+		}
+	}
+
+	// Строка формата резервируется сейчас и перезаписывается после выбора маски
+	q.drawFormatBits(level, 0)
+	q.drawVersion()
+}
+
+// drawFinder рисует поисковый узор с белой рамкой вокруг центра (x, y).
+func (q *QRCode) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || yy < 0 || xx >= q.Size || yy >= q.Size {
+				continue
+			}
+			dist := chebyshev(dx, dy)
+			q.setFunction(xx, yy, dist != 2 && dist != 4)
+		}
+	}
+}
+
+func (q *QRCode) drawAlignment(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			q.setFunction(x+dx, y+dy, chebyshev(dx, dy) != 1)
+		}
+	}
+}
+
+// qrFormatBits — 15 бит строки формата с кодом БЧХ и маской 0x5412.
+func qrFormatBits(level QRLevel, mask int) int {
+	data := qrFormatLevel[level]<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+func (q *QRCode) drawFormatBits(level QRLevel, mask int) {
+	bits := qrFormatBits(level, mask)
+	bit := func(i int) bool { return (bits>>i)&1 != 0 }
+
+	// Первая копия вокруг левого верхнего поискового узора
+	for i := 0; i <= 5; i++ {
+		q.setFunction(8, i, bit(i))
+	}
+	q.setFunction(8, 7, bit(6))
+	q.setFunction(8, 8, bit(7))
+	q.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.setFunction(14-i, 8, bit(i))
+	}
+
+	// Вторая копия разделена между двумя другими узорами
+	for i := 0; i < 8; i++ {
+		q.setFunction(q.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.setFunction(8, q.Size-15+i, bit(i))
+	}
+	q.setFunction(8, q.Size-8, true)
+}
+
+// qrVersionBits — 18 бит информации о версии с кодом Голея.
+func qrVersionBits(version int) int {
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	return version<<12 | rem
+}
+
+func (q *QRCode) drawVersion() {
+	if q.Version < 7 {
+		return
+	}
+
+	bits := qrVersionBits(q.Version)
+	for i := 0; i < 18; i++ {
+		dark := (bits>>i)&1 != 0
+		a, b := q.Size-11+i%3, i/3
+		q.setFunction(a, b, dark)
+		q.setFunction(b, a, dark)
+	}
+}
+
+// drawCodewords раскладывает биты змейкой по парам столбцов справа налево.
+func (q *QRCode) drawCodewords(data []byte) {
+	i := 0
+	for right := q.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			// Столбец вертикального синхронизирующего узора пропускается
+			right = 5
+		}
+		for vert := 0; vert < q.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.Size - 1 - vert
+				}
+				if !q.isFunction[y][x] && i < len(data)*8 {
+					q.modules[y][x] = (data[i>>3]>>(7-(i&7)))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+func qrMaskBit(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	}
+	return ((x+y)%2+x*y%3)%2 == 0
+}
+
+func (q *QRCode) applyMask(mask int) {
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			if !q.isFunction[y][x] && qrMaskBit(mask, x, y) {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty считает штраф маски по четырём правилам стандарта.
+func (q *QRCode) penalty() int {
+	const (
+		n1, n2, n3, n4 = 3, 3, 40, 10
+	)
+
+	score := 0
+	finderLike := [][]bool{
+		{true, false, true, true, true, false, true, false, false, false, false},
+		{false, false, false, false, true, false, true, true, true, false, true},
+	}
+
+	for dir := 0; dir < 2; dir++ {
+		at := func(i, j int) bool {
+			if dir == 0 {
+				return q.modules[i][j]
+			}
+			return q.modules[j][i]
+		}
+
+		for i := 0; i < q.Size; i++ {
+			// Правило 1: пять и более одинаковых модулей подряд
+			run := 1
+			for j := 1; j <= q.Size; j++ {
+				if j < q.Size && at(i, j) == at(i, j-1) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += n1 + run - 5
+				}
+				run = 1
+			}
+
+			// Правило 3: узор, похожий на поисковый, с белым полем с одной из сторон
+			for j := 0; j+11 <= q.Size; j++ {
+				for _, pattern := range finderLike {
+					match := true
+					for k, dark := range pattern {
+						if at(i, j+k) != dark {
+							match = false
+							break
+						}
+					}
+					if match {
+						score += n3
+					}
+				}
+			}
+		}
+	}
+
+	// Правило 2: одноцветные квадраты 2×2
+	dark := 0
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x+1 < q.Size && y+1 < q.Size {
+				c := q.modules[y][x]
+				if c == q.modules[y][x+1] && c == q.modules[y+1][x] && c == q.modules[y+1][x+1] {
+					score += n2
+				}
+			}
+		}
+	}
+
+	// Правило 4: отклонение доли тёмных модулей от половины, по 5 процентов
+	total := q.Size * q.Size
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	score += k * n4
+
+	return score
+}
+
+// Image рисует QR-код: scale точек на модуль и белое поле шириной margin модулей.
+func (q *QRCode) Image(scale, margin int) image.Image {
+	full := (q.Size + 2*margin) * scale
+	img := image.NewPaletted(image.Rect(0, 0, full, full), color.Palette{color.White, color.Black})
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			if !q.modules[y][x] {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				row := ((y+margin)*scale + dy) * img.Stride
+				for dx := 0; dx < scale; dx++ {
+					img.Pix[row+(x+margin)*scale+dx] = 1
+				}
+			}
+		}
+	}
+	return img
+}
+
+// SVG рисует QR-код векторно одним контуром; size — ширина и высота в пикселях.
+func (q *QRCode) SVG(size, margin int) []byte {
+	full := q.Size + 2*margin
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size, full, full)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, full, full)
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			if q.modules[y][x] {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x+margin, y+margin)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes()
+}
+
+// chebyshev — расстояние от центра узора до модуля со смещением (dx, dy).
+func chebyshev(dx, dy int) int {
+	if abs(dx) > abs(dy) {
+		return abs(dx)
+	}
+	return abs(dy)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}